@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/na--/winston/torrent/metadata"
+
+	log "github.com/golang/glog"
+
+	"github.com/nictuku/dht"
+)
+
+var (
+	crawlDHTPort  *int
+	crawlDownload *bool
+)
+
+var crawlCommand = &command{
+	name:        "crawl",
+	description: "Run a DHT node and print the infohashes that other nodes are looking for, one per line.",
+	setFlags: func(fs *flag.FlagSet) {
+		crawlDHTPort = fs.Int("dht_port", 0, "UDP port of the DHT node, a random one if 0. Nodes with a stable port are queried more.")
+		crawlDownload = fs.Bool("download", false, "Also download the metadata of the discovered torrents.")
+	},
+	run: crawl,
+}
+
+// How many discovered infohashes can wait to be printed before new ones are dropped
+const discoveredBuffer = 1000
+
+// How many infohashes are remembered in each generation of the duplicate filter.
+// Infohashes that were not queried during the last two generations are printed
+// again, but the memory use of long crawls stays bounded.
+const maxSeenInfoHashes = 100000
+
+// A dht.Logger that collects the infohashes from the get_peers queries of other nodes
+type infoHashCollector struct {
+	mu       sync.Mutex
+	seen     map[dht.InfoHash]bool
+	previous map[dht.InfoHash]bool // The older generation of seen
+	found    chan dht.InfoHash
+}
+
+func newInfoHashCollector() *infoHashCollector {
+	return &infoHashCollector{seen: make(map[dht.InfoHash]bool), found: make(chan dht.InfoHash, discoveredBuffer)}
+}
+
+// GetPeers implements dht.Logger, it's called by the DHT node for every get_peers query
+func (c *infoHashCollector) GetPeers(addr net.UDPAddr, queryID string, infoHash dht.InfoHash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[infoHash] {
+		return
+	}
+	if c.previous[infoHash] {
+		// Still popular, so it's kept in the current generation
+		c.remember(infoHash)
+		return
+	}
+
+	// The DHT node must not be blocked
+	select {
+	case c.found <- infoHash:
+		c.remember(infoHash)
+	default:
+		log.V(3).Infof("WINSTON: Dropping discovered infohash %x, nobody is reading them\n", infoHash)
+	}
+}
+
+// Should be called with the mutex held
+func (c *infoHashCollector) remember(infoHash dht.InfoHash) {
+	if len(c.seen) >= maxSeenInfoHashes {
+		c.previous = c.seen
+		c.seen = make(map[dht.InfoHash]bool)
+	}
+	c.seen[infoHash] = true
+}
+
+func crawl(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("The crawl command has no arguments, run 'winston help crawl' for the usage")
+	}
+
+	options, err := metadata.OptionsFromFlags()
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+
+	collector := newInfoHashCollector()
+	config := dht.NewConfig()
+	config.Port = *crawlDHTPort
+	node, err := dht.New(config)
+	if err != nil {
+		return fmt.Errorf("Could not create a DHT node: %s", err)
+	}
+	node.Logger = collector
+
+	// The manager shares our DHT node, so it doesn't start its own. The peer
+	// source has to be created before the node is started.
+	var peerSource *metadata.DHTPeerSource
+	if *crawlDownload {
+		peerSource = metadata.NewDHTPeerSource(node, options.DHTMinNodes)
+	}
+	go node.Run()
+	defer node.Stop()
+	if peerSource != nil {
+		defer peerSource.Stop()
+	}
+
+	var manager *metadata.Manager
+	if *crawlDownload {
+		options.PeerSource = peerSource
+		manager, err = metadata.NewManager(options)
+		if err != nil {
+			return fmt.Errorf("Could not start the download manager: %s", err)
+		}
+		defer manager.Close()
+	}
+
+	signals := notifyShutdown()
+	log.V(1).Infof("WINSTON: Crawling the DHT on port %d...\n", node.Port())
+	for {
+		select {
+		case infoHash := <-collector.found:
+			fmt.Printf("%x\n", infoHash)
+			if manager != nil {
+				if _, err := manager.Add(context.Background(), fmt.Sprintf("%x", infoHash)); err != nil {
+					return fmt.Errorf("Could not add %x: %s", infoHash, err)
+				}
+			}
+		case <-signals:
+			// The discovered torrents are not saved, new ones are found all the time
+			return nil
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/nictuku/dht"
+)
+
+func TestInfoHashCollectorDuplicates(t *testing.T) {
+	c := newInfoHashCollector()
+	c.found = make(chan dht.InfoHash, 3*maxSeenInfoHashes)
+	query := func(i int) {
+		ih := make([]byte, 20)
+		binary.BigEndian.PutUint32(ih, uint32(i))
+		c.GetPeers(net.UDPAddr{}, "", dht.InfoHash(ih))
+	}
+	expectFound := func(want int, when string) {
+		if len(c.found) != want {
+			t.Fatalf("Expected %d infohashes %s, got %d", want, when, len(c.found))
+		}
+	}
+
+	query(0)
+	query(0)
+	expectFound(1, "after a duplicate")
+
+	// The first generation is full, but its infohashes are still filtered
+	for i := 1; i <= maxSeenInfoHashes; i++ {
+		query(i)
+	}
+	expectFound(maxSeenInfoHashes+1, "after the first generation")
+	query(0)
+	expectFound(maxSeenInfoHashes+1, "from the previous generation")
+
+	// Once another generation is full, the old infohashes are forgotten
+	for i := maxSeenInfoHashes + 1; i <= 2*maxSeenInfoHashes; i++ {
+		query(i)
+	}
+	expectFound(2*maxSeenInfoHashes+1, "after the second generation")
+	query(1)
+	expectFound(2*maxSeenInfoHashes+2, "from a forgotten generation")
+	query(0)
+	expectFound(2*maxSeenInfoHashes+2, "that was queried again")
+
+	if remembered := len(c.seen) + len(c.previous); remembered > 2*maxSeenInfoHashes {
+		t.Errorf("%d infohashes are remembered", remembered)
+	}
+}
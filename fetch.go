@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+var (
+	fetchInput   *string
+	fetchResults *string
+	fetchQueue   *string
+)
+
+var fetchCommand = &command{
+	name:        "fetch",
+	args:        "[infohash1|magnet1 infohash2|magnet2 ...]",
+	description: "Download the metadata of the torrents and save it in the output folder.",
+	setFlags: func(fs *flag.FlagSet) {
+		fetchInput = fs.String("input", "", "File with more torrents, '-' for stdin. Every line is an infohash, a magnet link or a JSON object "+
+			"with the fields 'magnet', 'name', 'trackers', 'priority' and 'deadline' (RFC 3339); # starts a comment.")
+		fetchResults = fs.String("results", "", "File where the result for every torrent is appended as a line of JSON, '-' for stdout (disabled if empty).")
+		fetchQueue = fs.String("queue_file", "", "File with a durable queue of torrents: all the torrents are added to it and the failed downloads "+
+			"are retried later, see -max_attempts. Deadlines are ignored. Runs until no torrents in the queue are pending (disabled if empty).")
+		setStateFlags(fs)
+	},
+	run: fetch,
+}
+
+func fetch(args []string) (err error) {
+	// Check the arguments first, so we don't wait for downloads that never started
+	var items []*inputItem
+	for _, input := range args {
+		magnet, err := metadata.ParseMagnet(input)
+		if err != nil {
+			return fmt.Errorf("Invalid infohash or magnet link '%s': %s", input, err)
+		}
+		items = append(items, &inputItem{Magnet: input, magnet: magnet})
+	}
+
+	options, err := metadata.OptionsFromFlags()
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+
+	// The unfinished downloads from the last run go first
+	items = append(loadState(), items...)
+	if len(items) == 0 && *fetchInput == "" && *fetchQueue == "" {
+		return fmt.Errorf("No infohashes or magnet links were specified, run 'winston help fetch' for the usage")
+	}
+	signals := notifyShutdown()
+
+	var results *resultWriter
+	if *fetchResults != "" {
+		if results, err = newResultWriter(*fetchResults); err != nil {
+			return err
+		}
+		defer results.Close()
+		// Missing results are a failure, even if all downloads were successful
+		defer func() {
+			if writeErr := results.Err(); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}()
+	}
+
+	manager, err := metadata.NewManager(options)
+	if err != nil {
+		return fmt.Errorf("Could not start the download manager: %s", err)
+	}
+	defer manager.Close()
+
+	if *fetchQueue != "" {
+		return fetchFromQueue(manager, items, results, signals)
+	}
+
+	// The input can be endless, so the downloads are not kept around after they finish
+	var total, failed int32
+	var wg sync.WaitGroup
+	add := func(item *inputItem) error {
+		atomic.AddInt32(&total, 1)
+		if item.err != nil {
+			atomic.AddInt32(&failed, 1)
+			if results != nil {
+				return results.write(newInvalidResult(item.raw, item.err))
+			}
+			fmt.Fprintln(os.Stderr, item.err)
+			return nil
+		}
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if !item.Deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, item.Deadline)
+		}
+		download, err := manager.AddMagnet(ctx, item.magnet, item.Priority)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("Could not add '%s': %s", item.Magnet, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			result := download.Result()
+			if result.Err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+			if results != nil {
+				results.write(newJSONResult(item.Magnet, result))
+			}
+		}()
+		return nil
+	}
+
+	if interrupted, err := addItems(items, add, signals); err != nil {
+		return err
+	} else if interrupted {
+		err := shutdown(manager, signals)
+		wg.Wait() // For the results of the aborted downloads
+		return err
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-signals:
+		err := shutdown(manager, signals)
+		<-finished
+		return err
+	}
+
+	// Everything is done, so there is nothing to resume
+	if err := saveState(nil); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("The metadata of %d out of %d torrents could not be downloaded", failed, total)
+	}
+	return nil
+}
+
+// Passes the items and then the -input, if there is one, to add. It returns early
+// if a signal is received, no new input is read after that.
+func addItems(items []*inputItem, add func(*inputItem) error, signals <-chan os.Signal) (interrupted bool, err error) {
+	for _, item := range items {
+		if err = add(item); err != nil {
+			return
+		}
+	}
+
+	var input <-chan *inputItem
+	if *fetchInput != "" {
+		input = readInput(*fetchInput)
+	}
+	for input != nil {
+		select {
+		case item, ok := <-input:
+			if !ok {
+				input = nil
+			} else if err = add(item); err != nil {
+				return
+			}
+		case <-signals:
+			return true, nil
+		}
+	}
+	return
+}
+
+// Adds all torrents to the queue and downloads them from it, until none are pending
+func fetchFromQueue(manager *metadata.Manager, items []*inputItem, results *resultWriter, signals <-chan os.Signal) error {
+	queue, err := metadata.OpenQueue(*fetchQueue)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+	started := time.Now()
+
+	// A download can be retried multiple times, so every attempt has its own result
+	var wg sync.WaitGroup
+	if results != nil {
+		managerResults := manager.Results()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range managerResults {
+				results.write(newJSONResult(result.Magnet.URI(), result))
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queueErr := make(chan error, 1)
+	go func() {
+		queueErr <- manager.RunQueue(ctx, queue)
+	}()
+	stop := func() error {
+		cancel()
+		err := <-queueErr
+		manager.Close()
+		wg.Wait()
+		return err
+	}
+
+	invalid := 0
+	add := func(item *inputItem) error {
+		if item.err != nil {
+			invalid++
+			if results != nil {
+				return results.write(newInvalidResult(item.raw, item.err))
+			}
+			fmt.Fprintln(os.Stderr, item.err)
+			return nil
+		}
+		_, err := queue.Push(item.magnet, item.Priority)
+		return err
+	}
+
+	interrupted, err := addItems(items, add, signals)
+wait:
+	for !interrupted && err == nil {
+		changed := queue.Changed()
+		if unfinished, _, _ := queue.Unfinished(); unfinished == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case queueResult := <-queueErr:
+			queueErr <- queueResult // For stop()
+			break wait
+		case <-signals:
+			interrupted = true
+		}
+	}
+
+	if interrupted {
+		// The aborted downloads stay in the queue, they are resumed on the next run
+		shutdownErr := shutdown(manager, signals)
+		if err := stop(); err != nil {
+			return err
+		}
+		return shutdownErr
+	}
+	if stopErr := stop(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The saved downloads were pushed to the queue, which keeps them from now on
+	if err := saveState(nil); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, job := range queue.Jobs() {
+		if job.State == metadata.JobFailed && job.Updated.After(started) {
+			failed++
+		}
+	}
+	if failed+invalid > 0 {
+		return fmt.Errorf("The metadata of %d torrents could not be downloaded and %d were invalid", failed, invalid)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+// Magnet links with a lot of trackers can be quite long
+const maxInputLineSize = 1024 * 1024
+
+// A single torrent from the input. In JSON Lines input every line is a JSON
+// object with these fields, otherwise it's just an infohash or a magnet link.
+type inputItem struct {
+	Magnet   string    `json:"magnet"`   // An infohash or a magnet link
+	Name     string    `json:"name"`     // Overrides the display name of the magnet link
+	Trackers []string  `json:"trackers"` // Used in addition to the trackers of the magnet link
+	Priority int       `json:"priority"` // Higher priority torrents are started first when downloads are queued
+	Deadline time.Time `json:"deadline"` // The download is aborted after that, if set
+
+	magnet *metadata.Magnet
+	raw    string // The line of the input, kept for invalid lines
+	err    error  // Why the line could not be parsed
+}
+
+// Parses a line of the input, nil is returned for empty lines and comments
+func parseInputLine(line string) (item *inputItem, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	item = &inputItem{}
+	if strings.HasPrefix(line, "{") {
+		if err = json.Unmarshal([]byte(line), item); err != nil {
+			return nil, fmt.Errorf("Invalid JSON: %s", err)
+		}
+	} else {
+		// Infohashes and magnet links have no spaces, so everything after them should be a comment
+		fields := strings.Fields(line)
+		if len(fields) > 1 && !strings.HasPrefix(fields[1], "#") {
+			return nil, fmt.Errorf("Unexpected text after '%s'", fields[0])
+		}
+		item.Magnet = fields[0]
+	}
+
+	if item.magnet, err = metadata.ParseMagnet(item.Magnet); err != nil {
+		return nil, fmt.Errorf("Invalid infohash or magnet link '%s': %s", item.Magnet, err)
+	}
+	if item.Name != "" {
+		item.magnet.DisplayName = item.Name
+	}
+	item.magnet.Trackers = append(item.magnet.Trackers, item.Trackers...)
+	return
+}
+
+// Reads the items from the file, or from stdin if path is "-", and sends them to
+// the returned channel as soon as they are read, so that the input can be a pipe
+// that is never closed. Invalid lines are sent as items with only err set. The
+// channel is closed at the end of the input.
+func readInput(path string) <-chan *inputItem {
+	items := make(chan *inputItem)
+
+	go func() {
+		defer close(items)
+
+		var reader io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				items <- &inputItem{err: fmt.Errorf("Could not open the input: %s", err)}
+				return
+			}
+			defer f.Close()
+			reader = f
+		}
+
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), maxInputLineSize)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			item, err := parseInputLine(scanner.Text())
+			if err != nil {
+				items <- &inputItem{raw: strings.TrimSpace(scanner.Text()), err: fmt.Errorf("%s:%d: %s", path, lineNumber, err)}
+			} else if item != nil {
+				items <- item
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			items <- &inputItem{err: fmt.Errorf("Could not read the input: %s", err)}
+		}
+	}()
+
+	return items
+}
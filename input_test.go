@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHex = "0123456789abcdef0123456789abcdef01234567"
+
+func TestParseInputLine(t *testing.T) {
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name         string
+		line         string
+		wantNil      bool
+		wantErr      string
+		wantName     string
+		wantTrackers []string
+		wantPriority int
+		wantDeadline time.Time
+	}{
+		{name: "empty", line: "", wantNil: true},
+		{name: "blank", line: " \t ", wantNil: true},
+		{name: "comment", line: "  # " + testHex, wantNil: true},
+		{name: "infohash", line: testHex},
+		{name: "infohash with a comment", line: testHex + "  # a comment"},
+		{name: "text after the infohash", line: testHex + " something", wantErr: "Unexpected text"},
+		{name: "invalid infohash", line: "0123", wantErr: "Invalid infohash or magnet link"},
+		{
+			name:         "magnet link",
+			line:         "magnet:?xt=urn:btih:" + testHex + "&dn=Test&tr=udp%3A%2F%2Ftracker.example.org%3A80",
+			wantName:     "Test",
+			wantTrackers: []string{"udp://tracker.example.org:80"},
+		},
+		{
+			name:         "JSON",
+			line:         `{"magnet": "magnet:?xt=urn:btih:` + testHex + `&dn=Test&tr=udp%3A%2F%2Fa", "name": "Other", "trackers": ["udp://b"], "priority": 5, "deadline": "2030-01-02T03:04:05Z"}`,
+			wantName:     "Other",
+			wantTrackers: []string{"udp://a", "udp://b"},
+			wantPriority: 5,
+			wantDeadline: deadline,
+		},
+		{name: "JSON with a negative priority", line: `{"magnet": "` + testHex + `", "priority": -1}`, wantPriority: -1},
+		{name: "invalid JSON", line: `{"magnet": "` + testHex + `"`, wantErr: "Invalid JSON"},
+		{name: "JSON with a wrong type", line: `{"magnet": "` + testHex + `", "priority": "high"}`, wantErr: "Invalid JSON"},
+		{name: "JSON without a magnet", line: `{"priority": 1}`, wantErr: "Invalid infohash or magnet link"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item, err := parseInputLine(test.line)
+			switch {
+			case test.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Expected an error with %q, got %v", test.wantErr, err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("Unexpected error: %s", err)
+			case test.wantNil:
+				if item != nil {
+					t.Fatalf("Expected no item, got %+v", item)
+				}
+				return
+			case item == nil:
+				t.Fatalf("Expected an item, got nil")
+			}
+
+			if got := item.magnet.String(); !strings.Contains(got, testHex) {
+				t.Errorf("Expected the infohash %s, got %s", testHex, got)
+			}
+			if item.magnet.DisplayName != test.wantName {
+				t.Errorf("Expected the name %q, got %q", test.wantName, item.magnet.DisplayName)
+			}
+			if !reflect.DeepEqual(item.magnet.Trackers, test.wantTrackers) {
+				t.Errorf("Expected the trackers %q, got %q", test.wantTrackers, item.magnet.Trackers)
+			}
+			if item.Priority != test.wantPriority {
+				t.Errorf("Expected the priority %d, got %d", test.wantPriority, item.Priority)
+			}
+			if !item.Deadline.Equal(test.wantDeadline) {
+				t.Errorf("Expected the deadline %s, got %s", test.wantDeadline, item.Deadline)
+			}
+		})
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.txt")
+	lines := []string{
+		"# Torrents to fetch",
+		testHex,
+		"",
+		"not an infohash",
+		`{"magnet": "` + strings.ToUpper(testHex) + `", "priority": 2}`,
+		"   ",
+		`{"magnet": `,
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("Could not write the input: %s", err)
+	}
+
+	var items []*inputItem
+	for item := range readInput(path) {
+		items = append(items, item)
+	}
+	if len(items) != 4 {
+		t.Fatalf("Expected 4 items, got %d", len(items))
+	}
+
+	// The invalid lines are reported in place, with their line numbers
+	for _, i := range []int{0, 2} {
+		if items[i].err != nil || items[i].magnet == nil {
+			t.Errorf("Item %d: expected a valid torrent, got %v", i, items[i].err)
+		}
+	}
+	if items[2].Priority != 2 {
+		t.Errorf("Expected the priority 2, got %d", items[2].Priority)
+	}
+	for i, wantLine := range map[int]int{1: 4, 3: 7} {
+		if items[i].err == nil || !strings.HasPrefix(items[i].err.Error(), fmt.Sprintf("%s:%d:", path, wantLine)) {
+			t.Errorf("Item %d: expected an error for line %d, got %v", i, wantLine, items[i].err)
+		}
+		if items[i].raw != strings.TrimSpace(lines[wantLine-1]) || items[i].magnet != nil {
+			t.Errorf("Item %d: expected only the raw line %q, got %q", i, lines[wantLine-1], items[i].raw)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	items = nil
+	for item := range readInput(missing) {
+		items = append(items, item)
+	}
+	if len(items) != 1 || items[0].err == nil {
+		t.Errorf("Expected a single error for a missing input, got %d items", len(items))
+	}
+}
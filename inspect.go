@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+var inspectFiles *bool
+
+var inspectCommand = &command{
+	name:        "inspect",
+	args:        "infohash1|magnet1|file1 [infohash2|magnet2|file2 ...]",
+	description: "Show the info dictionary of saved torrent files, specified by their path or by the infohash of a torrent in the output folder.",
+	setFlags: func(fs *flag.FlagSet) {
+		inspectFiles = fs.Bool("files", false, "List all the files in the torrents, not only their number.")
+	},
+	run: inspect,
+}
+
+// Loads the metadata for the path of a torrent file or for the infohash of a saved one
+func loadTorrent(folder, input string) (torrentMetadata []byte, err error) {
+	if _, statErr := os.Stat(input); statErr == nil {
+		return metadata.ReadTorrentFile(input)
+	}
+
+	magnet, err := metadata.ParseMagnet(input)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is neither a file nor a valid infohash: %s", input, err)
+	}
+	return metadata.SavedMetadata{Folder: folder}.Load(magnet.InfoHash)
+}
+
+func inspect(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("No torrents were specified, run 'winston help inspect' for the usage")
+	}
+
+	options, err := metadata.OptionsFromFlags()
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+
+	failed := 0
+	for i, input := range args {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		torrentMetadata, err := loadTorrent(options.OutputFolder, input)
+		if err != nil {
+			fmt.Printf("Could not load %s: %s\n", input, err)
+			failed++
+			continue
+		}
+		info, err := metadata.ParseInfo(torrentMetadata)
+		if err != nil {
+			fmt.Printf("Could not parse %s: %s\n", input, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("Torrent:      %s\n", input)
+		fmt.Printf("Name:         %s\n", info.Name)
+		for _, infoHash := range info.InfoHashes {
+			fmt.Printf("Infohash:     %x\n", infoHash)
+		}
+		fmt.Printf("Version:      %d\n", info.MetaVersion)
+		fmt.Printf("Private:      %t\n", info.Private)
+		fmt.Printf("Piece length: %d\n", info.PieceLength)
+		fmt.Printf("Total size:   %d\n", info.TotalSize)
+		fmt.Printf("Files:        %d\n", len(info.Files))
+		if *inspectFiles {
+			for _, file := range info.Files {
+				fmt.Printf("  %12d  %s\n", file.Length, file.Path)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d out of %d torrents could not be inspected", failed, len(args))
+	}
+	return nil
+}
@@ -4,30 +4,140 @@ import (
 	"flag"
 	"fmt"
 	"os"
-
-	"github.com/na--/winston/torrent/metadata"
 )
 
+// A subcommand of winston, with its own flags in addition to the common ones
+type command struct {
+	name        string
+	args        string // Shown in the usage line, after the options
+	description string
+	setFlags    func(fs *flag.FlagSet) // Defines the command's own flags, can be nil
+	run         func(args []string) error
+}
+
+var commands = []*command{fetchCommand, inspectCommand, verifyCommand, serveCommand, crawlCommand}
+
+// The command that is used when the first argument is not a command name, so that
+// the old "winston [options] infohash ..." invocations keep working
+var defaultCommand = fetchCommand
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Printf("Usage: %v <command> [options] [arguments]\n\n", os.Args[0])
+	fmt.Println("Commands:")
+	for _, c := range commands {
+		fmt.Printf("  %-8s %s\n", c.name, c.description)
+	}
+	fmt.Println()
+	fmt.Printf("Run '%v help <command>' for the options of a command and '%v help options' for the common options.\n", os.Args[0], os.Args[0])
+	fmt.Printf("Without a command, the arguments are passed to '%s'.\n", defaultCommand.name)
+}
+
+// Prints the usage and the own options of the command, ownFlags are their names
+func (c *command) printHelp(ownFlags map[string]bool) {
+	fmt.Printf("Usage: %v %s [options] %s\n\n", os.Args[0], c.name, c.args)
+	fmt.Println(c.description)
+	if len(ownFlags) > 0 {
+		fmt.Println()
+		fmt.Println("Options:")
+		printFlags(func(f *flag.Flag) bool { return ownFlags[f.Name] })
+	}
+	fmt.Println()
+	fmt.Printf("Run '%v help options' for the common options.\n", os.Args[0])
+}
+
+// Prints the defaults of the global flags that match the filter
+func printFlags(filter func(f *flag.Flag) bool) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	flag.VisitAll(func(f *flag.Flag) {
+		if filter(f) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.PrintDefaults()
+}
+
+// Adds the own flags of the command to the global ones and returns their names.
+// They are global, so that they can be set in the config file as well.
+func (c *command) defineFlags() (ownFlags map[string]bool) {
+	ownFlags = make(map[string]bool)
+	if c.setFlags == nil {
+		return
+	}
+
+	existing := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		existing[f.Name] = true
+	})
+	c.setFlags(flag.CommandLine)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !existing[f.Name] {
+			ownFlags[f.Name] = true
+		}
+	})
+	return
+}
+
+func help(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+
+	if args[0] == "options" {
+		fmt.Println("Common options:")
+		printFlags(func(f *flag.Flag) bool { return f.Name != "h" })
+		return
+	}
+
+	c := findCommand(args[0])
+	if c == nil {
+		fmt.Printf("Unknown command '%s'\n\n", args[0])
+		printUsage()
+		os.Exit(1)
+	}
+	c.printHelp(c.defineFlags())
+}
+
 func main() {
 	var showHelp bool
 	flag.BoolVar(&showHelp, "h", false, "Show help message")
-	flag.Parse()
 
-	if showHelp || flag.NArg() == 0 {
-		//
-		fmt.Printf("Usage: %v infohash1 [infohash2 ...]\n\n", os.Args[0])
-		fmt.Println("Example infohash: 4d753474429d817b80ff9e0c441ca660ec5d2450")
-		fmt.Println()
-		fmt.Println("Options:")
-		flag.PrintDefaults()
+	args := os.Args[1:]
+	if len(args) == 0 {
+		printUsage()
 		os.Exit(1)
 	}
+	if args[0] == "help" || args[0] == "-h" {
+		help(args[1:])
+		return
+	}
 
-	filesToDownload, finished := metadata.StartNewDownloadManager()
+	c := defaultCommand
+	if named := findCommand(args[0]); named != nil {
+		c, args = named, args[1:]
+	}
+
+	ownFlags := c.defineFlags()
+	flag.Usage = func() { c.printHelp(ownFlags) }
+	flag.CommandLine.Parse(args)
 
-	for _, infoHash := range flag.Args() {
-		filesToDownload <- infoHash
+	if showHelp {
+		c.printHelp(ownFlags)
+		return
 	}
 
-	<-finished
+	if err := c.run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
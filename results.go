@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/na--/winston/torrent/metadata"
+
+	log "github.com/golang/glog"
+)
+
+// The outcome for a single torrent, one JSON object per line in the results output
+type jsonResult struct {
+	InfoHash     string     `json:"infohash,omitempty"`
+	Input        string     `json:"input"`
+	Status       string     `json:"status"` // "downloaded", "timeout", "aborted", "failed" or "invalid"
+	Error        string     `json:"error,omitempty"`
+	Path         string     `json:"path,omitempty"`
+	MetadataSize int        `json:"metadata_size,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	TotalSize    int64      `json:"total_size,omitempty"`
+	PeersTried   int        `json:"peers_tried"`
+	Peer         string     `json:"peer,omitempty"`
+	Timing       jsonTiming `json:"timing"`
+}
+
+// All durations are in seconds
+type jsonTiming struct {
+	Queued    float64 `json:"queued"`
+	FirstPeer float64 `json:"first_peer,omitempty"`
+	Download  float64 `json:"download"`
+	Total     float64 `json:"total"`
+}
+
+// Writes the results as JSON Lines, it's safe for concurrent use
+type resultWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	err     error // The first write error
+}
+
+// Creates a writer for the file, stdout if path is "-". Files are appended to,
+// so the results of multiple runs can be collected in one place.
+func newResultWriter(path string) (w *resultWriter, err error) {
+	w = &resultWriter{}
+	if path == "-" {
+		w.encoder = json.NewEncoder(os.Stdout)
+	} else {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open the results file: %s", err)
+		}
+		w.encoder = json.NewEncoder(f)
+		w.closer = f
+	}
+	// Magnet links are easier to read without escaped ampersands
+	w.encoder.SetEscapeHTML(false)
+	return
+}
+
+// Writes a single result. Errors are logged as well, since the results may be
+// written to stdout and the callers running in the background can't do much
+// more about them.
+func (w *resultWriter) write(result jsonResult) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err = w.encoder.Encode(result); err != nil {
+		err = fmt.Errorf("Could not write the result for %s: %s", result.Input, err)
+		log.Errorf("WINSTON: %s\n", err)
+		if w.err == nil {
+			w.err = err
+		}
+	}
+	return
+}
+
+// Err returns the first error from write, if there was one
+func (w *resultWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close closes the results file, if it's not stdout
+func (w *resultWriter) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Converts the result of a download
+func newJSONResult(input string, result metadata.Result) jsonResult {
+	jr := jsonResult{
+		InfoHash:   hex.EncodeToString([]byte(result.InfoHash)),
+		Input:      input,
+		Status:     "downloaded",
+		Path:       result.Path,
+		Peer:       result.Peer,
+		PeersTried: result.PeersTried,
+		Timing: jsonTiming{
+			Queued:    result.QueueTime.Seconds(),
+			FirstPeer: result.FirstPeer.Seconds(),
+			Download:  result.Duration.Seconds(),
+			Total:     (result.QueueTime + result.Duration).Seconds(),
+		},
+	}
+
+	switch result.Err {
+	case nil:
+	case metadata.ErrDownloadTimeout, context.DeadlineExceeded:
+		jr.Status = "timeout"
+	case metadata.ErrManagerClosed, context.Canceled:
+		jr.Status = "aborted"
+	default:
+		jr.Status = "failed"
+	}
+	if result.Err != nil {
+		jr.Error = result.Err.Error()
+	}
+
+	if result.Metadata != nil {
+		jr.MetadataSize = len(result.Metadata)
+		if info, err := metadata.ParseInfo(result.Metadata); err == nil {
+			jr.Name = info.Name
+			jr.TotalSize = info.TotalSize
+		}
+	}
+	return jr
+}
+
+// The result for an input line that is not a valid infohash or magnet link
+func newInvalidResult(input string, err error) jsonResult {
+	return jsonResult{Input: input, Status: "invalid", Error: err.Error()}
+}
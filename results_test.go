@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+func TestNewJSONResult(t *testing.T) {
+	infoHash := strings.Repeat("\x01", 20)
+	info := []byte("d6:lengthi1024e4:name4:test12:piece lengthi16384e6:pieces20:01234567890123456789e")
+	tests := []struct {
+		name       string
+		err        error
+		metadata   []byte
+		wantStatus string
+	}{
+		{"downloaded", nil, info, "downloaded"},
+		{"timeout", metadata.ErrDownloadTimeout, nil, "timeout"},
+		{"deadline", context.DeadlineExceeded, nil, "timeout"},
+		{"closed", metadata.ErrManagerClosed, nil, "aborted"},
+		{"cancelled", context.Canceled, nil, "aborted"},
+		{"failed", errors.New("Could not save the torrent"), info, "failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := metadata.Result{
+				InfoHash:   infoHash,
+				Metadata:   test.metadata,
+				PeersTried: 3,
+				QueueTime:  time.Second,
+				Duration:   2 * time.Second,
+				Err:        test.err,
+			}
+			jr := newJSONResult("input", result)
+			if jr.Status != test.wantStatus {
+				t.Errorf("Expected the status %q, got %q", test.wantStatus, jr.Status)
+			}
+			if jr.InfoHash != strings.Repeat("01", 20) || jr.Input != "input" || jr.PeersTried != 3 {
+				t.Errorf("Unexpected result %+v", jr)
+			}
+			if jr.Timing.Total != 3 {
+				t.Errorf("Expected a total time of 3s, got %v", jr.Timing.Total)
+			}
+			if (test.err == nil) != (jr.Error == "") {
+				t.Errorf("Unexpected error %q for %v", jr.Error, test.err)
+			}
+			if test.metadata != nil && (jr.Name != "test" || jr.TotalSize != 1024 || jr.MetadataSize != len(info)) {
+				t.Errorf("Expected the torrent info, got %+v", jr)
+			}
+		})
+	}
+
+	jr := newInvalidResult("not a magnet", errors.New("Invalid infohash"))
+	if want := (jsonResult{Input: "not a magnet", Status: "invalid", Error: "Invalid infohash"}); !reflect.DeepEqual(jr, want) {
+		t.Errorf("Expected %+v for an invalid line, got %+v", want, jr)
+	}
+}
+
+func TestResultWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	const magnet = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=a&tr=b"
+	ok := jsonResult{InfoHash: "0123456789abcdef0123456789abcdef01234567", Input: magnet, Status: "downloaded", Path: "a.torrent"}
+	invalid := newInvalidResult("bad", errors.New("Invalid"))
+
+	// The file is appended to by every writer
+	for _, result := range []jsonResult{ok, invalid} {
+		w, err := newResultWriter(path)
+		if err != nil {
+			t.Fatalf("Could not create the writer: %s", err)
+		}
+		if err := w.write(result); err != nil {
+			t.Fatalf("Could not write the result: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Could not close the writer: %s", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open the results: %s", err)
+	}
+	defer f.Close()
+	var lines []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	if !strings.Contains(lines[0], `"input":"`+magnet+`"`) {
+		t.Errorf("Expected the magnet link without escaping, got %s", lines[0])
+	}
+	for i, want := range []jsonResult{ok, invalid} {
+		var got jsonResult
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Line %d: expected %+v, got %+v (%v)", i+1, want, got, err)
+		}
+	}
+	// Empty fields are omitted
+	if strings.Contains(lines[0], `"error"`) {
+		t.Errorf("Expected no error field for a download, got %s", lines[0])
+	}
+	for _, field := range []string{`"infohash"`, `"path"`} {
+		if strings.Contains(lines[1], field) {
+			t.Errorf("Expected no %s field for an invalid line, got %s", field, lines[1])
+		}
+	}
+
+	// Write errors are remembered
+	w, err := newResultWriter(path)
+	if err != nil {
+		t.Fatalf("Could not create the writer: %s", err)
+	}
+	w.Close()
+	if err := w.write(ok); err == nil || w.Err() != err {
+		t.Errorf("Expected the write error to be remembered, got %v and %v", err, w.Err())
+	}
+}
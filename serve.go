@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	serveHTTPAddress *string
+	serveQueue       *string
+)
+
+var serveCommand = &command{
+	name:        "serve",
+	description: "Run a long-lived node that downloads the torrents added through its HTTP API. Use -listen to serve the saved metadata to other peers as well.",
+	setFlags: func(fs *flag.FlagSet) {
+		serveHTTPAddress = fs.String("http", "127.0.0.1:8080", "Address of the HTTP API.")
+		serveQueue = fs.String("queue_file", "", "File with a durable queue of torrents: the added torrents are saved in it and the failed downloads are retried later, see -max_attempts (disabled if empty).")
+		setStateFlags(fs)
+	},
+	run: serve,
+}
+
+// The state of a download, as it's shown by the API
+type downloadStatus struct {
+	InfoHash    string     `json:"infohash"`
+	Name        string     `json:"name,omitempty"`
+	Status      string     `json:"status"` // "queued", "downloading", "downloaded" or "failed"
+	Error       string     `json:"error,omitempty"`
+	Peer        string     `json:"peer,omitempty"`
+	Duration    float64    `json:"duration,omitempty"`     // In seconds
+	Attempts    int        `json:"attempts,omitempty"`     // Only with a queue
+	NextAttempt *time.Time `json:"next_attempt,omitempty"` // For failed attempts that will be retried
+}
+
+// The API statuses of the queue's jobs
+var jobStatuses = map[metadata.JobState]string{
+	metadata.JobPending:    "queued",
+	metadata.JobInProgress: "downloading",
+	metadata.JobDone:       "downloaded",
+	metadata.JobFailed:     "failed",
+}
+
+// Serves the HTTP API for a Manager
+type apiServer struct {
+	manager *metadata.Manager
+	saved   metadata.SavedMetadata
+	queue   *metadata.Queue // The torrents are added to it instead of the manager, if it's not nil
+
+	mu        sync.Mutex
+	downloads map[string]*metadata.Download // By hex infohash
+}
+
+func serve(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("The serve command has no arguments, run 'winston help serve' for the usage")
+	}
+
+	options, err := metadata.OptionsFromFlags()
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+
+	manager, err := metadata.NewManager(options)
+	if err != nil {
+		return fmt.Errorf("Could not start the download manager: %s", err)
+	}
+	defer manager.Close()
+
+	server := &apiServer{
+		manager:   manager,
+		saved:     metadata.SavedMetadata{Folder: options.OutputFolder},
+		downloads: make(map[string]*metadata.Download),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/downloads", server.handleDownloads)
+	mux.HandleFunc("/downloads/", server.handleDownload)
+	mux.HandleFunc("/torrents/", server.handleTorrent)
+
+	// The manager downloads the torrents from the queue until it's shut down
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	queueErr := make(chan error, 1)
+	if *serveQueue != "" {
+		if server.queue, err = metadata.OpenQueue(*serveQueue); err != nil {
+			return err
+		}
+		defer server.queue.Close()
+		go func() {
+			queueErr <- manager.RunQueue(queueCtx, server.queue)
+		}()
+	}
+
+	signals := notifyShutdown()
+	for _, item := range loadState() {
+		if _, err := server.add(item.magnet, item.Priority); err != nil {
+			log.Errorf("WINSTON: Could not resume %s: %s\n", item.magnet, err)
+		}
+	}
+
+	httpServer := &http.Server{Addr: *serveHTTPAddress, Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.V(1).Infof("WINSTON: Serving the HTTP API on %s\n", *serveHTTPAddress)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case err := <-queueErr:
+		return err
+	case <-signals:
+		// No new downloads are accepted through the API while the active ones finish
+		httpServer.Close()
+		err := shutdown(manager, signals)
+		if server.queue != nil {
+			// The aborted jobs are pending again once RunQueue returns
+			stopQueue()
+			manager.Close()
+			if queueErr := <-queueErr; queueErr != nil {
+				return queueErr
+			}
+		}
+		return err
+	}
+}
+
+// Adds the torrent to the queue, if there is one, or to the manager and returns its status
+func (s *apiServer) add(magnet *metadata.Magnet, priority int) (status downloadStatus, err error) {
+	infoHash := hex.EncodeToString([]byte(magnet.InfoHash))
+	if s.queue != nil {
+		if _, err = s.queue.Push(magnet, priority); err != nil {
+			return
+		}
+		status, _ = s.statusOf(infoHash)
+		return
+	}
+
+	download, err := s.manager.AddMagnet(context.Background(), magnet, priority)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.downloads[infoHash] = download
+	s.mu.Unlock()
+	return s.status(download), nil
+}
+
+// Returns the status of the torrent with the hex infohash, if it was added
+func (s *apiServer) statusOf(infoHash string) (status downloadStatus, ok bool) {
+	if s.queue != nil {
+		job, ok := s.queue.Get(infoHash)
+		if !ok {
+			return status, false
+		}
+		return jobStatus(job), true
+	}
+
+	s.mu.Lock()
+	download, ok := s.downloads[infoHash]
+	s.mu.Unlock()
+	if !ok {
+		return status, false
+	}
+	return s.status(download), true
+}
+
+func jobStatus(job metadata.Job) downloadStatus {
+	status := downloadStatus{InfoHash: job.InfoHash, Status: jobStatuses[job.State], Error: job.Error, Attempts: job.Attempts}
+	if magnet, err := metadata.ParseMagnet(job.Magnet); err == nil {
+		status.Name = magnet.DisplayName
+	}
+	if job.State == metadata.JobPending && !job.NextAttempt.IsZero() {
+		nextAttempt := job.NextAttempt
+		status.NextAttempt = &nextAttempt
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *apiServer) status(download *metadata.Download) downloadStatus {
+	magnet := download.Magnet()
+	status := downloadStatus{InfoHash: hex.EncodeToString([]byte(magnet.InfoHash)), Name: magnet.DisplayName, Status: "downloading"}
+
+	select {
+	case <-download.Done():
+	default:
+		return status
+	}
+
+	result := download.Result()
+	status.Status = "downloaded"
+	status.Peer = result.Peer
+	status.Duration = result.Duration.Seconds()
+	if result.Err != nil {
+		status.Status = "failed"
+		status.Error = result.Err.Error()
+	}
+	return status
+}
+
+// GET lists all downloads, POST adds the infohash or magnet link in the "magnet" parameter
+func (s *apiServer) handleDownloads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statuses := []downloadStatus{}
+		if s.queue != nil {
+			for _, job := range s.queue.Jobs() {
+				statuses = append(statuses, jobStatus(job))
+			}
+		} else {
+			s.mu.Lock()
+			for _, download := range s.downloads {
+				statuses = append(statuses, s.status(download))
+			}
+			s.mu.Unlock()
+		}
+		writeJSON(w, http.StatusOK, statuses)
+
+	case http.MethodPost:
+		magnet, err := metadata.ParseMagnet(r.FormValue("magnet"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		status, err := s.add(magnet, 0)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method))
+	}
+}
+
+// Shows the status of a single download, /downloads/<hex infohash>
+func (s *apiServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	magnet, err := metadata.ParseMagnet(strings.TrimPrefix(r.URL.Path, "/downloads/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if status, ok := s.statusOf(hex.EncodeToString([]byte(magnet.InfoHash))); ok {
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	// Torrents that were downloaded before the node was started
+	if _, err := s.saved.Load(magnet.InfoHash); err == nil {
+		writeJSON(w, http.StatusOK, downloadStatus{InfoHash: hex.EncodeToString([]byte(magnet.InfoHash)), Status: "downloaded"})
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("Unknown torrent %s", magnet))
+}
+
+// Sends the saved torrent file, /torrents/<hex infohash>.torrent
+func (s *apiServer) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	magnet, err := metadata.ParseMagnet(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/torrents/"), ".torrent"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Only verified files are served
+	if _, err := s.saved.Load(magnet.InfoHash); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Torrent %s is not available", magnet))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	http.ServeFile(w, r, s.saved.Path(magnet.InfoHash))
+}
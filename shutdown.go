@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	stateFile     *string
+	shutdownGrace *time.Duration
+)
+
+// Defines the flags of the commands that save their unfinished downloads on shutdown
+func setStateFlags(fs *flag.FlagSet) {
+	stateFile = fs.String("state_file", "", "File where the unfinished downloads are saved on SIGINT or SIGTERM, they are resumed from it on the next start (disabled if empty).")
+	shutdownGrace = fs.Duration("shutdown_grace", 10*time.Second, "How long the active downloads can take to finish after SIGINT or SIGTERM, a second signal stops them immediately.")
+}
+
+// Returns a channel that receives SIGINT and SIGTERM
+func notifyShutdown() <-chan os.Signal {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
+}
+
+// Shuts the manager down gracefully and saves the unfinished downloads to the state
+// file, if there is one. Another signal ends the grace period early.
+func shutdown(manager *metadata.Manager, signals <-chan os.Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	pending := manager.Shutdown(ctx)
+	if err := saveState(pending); err != nil {
+		return err
+	}
+	if *stateFile != "" && len(pending) > 0 {
+		return fmt.Errorf("Interrupted, %d unfinished downloads were saved to %s", len(pending), *stateFile)
+	}
+	return fmt.Errorf("Interrupted, %d downloads were not finished", len(pending))
+}
+
+// Writes the pending downloads to the state file in the -input format. The file is
+// removed when nothing is pending, so that finished work is not resumed.
+func saveState(pending []metadata.PendingDownload) error {
+	if *stateFile == "" {
+		return nil
+	}
+	if len(pending) == 0 {
+		if err := os.Remove(*stateFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove the state file: %s", err)
+		}
+		return nil
+	}
+
+	// Written to a temporary file first, so that a crash doesn't leave a partial state
+	tempFile := *stateFile + ".tmp"
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return fmt.Errorf("Could not create the state file: %s", err)
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetEscapeHTML(false)
+	for _, download := range pending {
+		item := struct {
+			Magnet   string `json:"magnet"`
+			Priority int    `json:"priority,omitempty"`
+		}{download.Magnet.URI(), download.Priority}
+		if err = encoder.Encode(item); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile, *stateFile)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("Could not save the state file: %s", err)
+	}
+
+	log.V(1).Infof("WINSTON: Saved %d unfinished downloads to %s\n", len(pending), *stateFile)
+	return nil
+}
+
+// Reads the downloads that were saved by saveState, if there are any
+func loadState() (items []*inputItem) {
+	if *stateFile == "" {
+		return
+	}
+	if _, err := os.Stat(*stateFile); os.IsNotExist(err) {
+		return
+	}
+
+	for item := range readInput(*stateFile) {
+		if item.err != nil {
+			log.Errorf("WINSTON: Skipping invalid saved download: %s\n", item.err)
+			continue
+		}
+		items = append(items, item)
+	}
+	log.V(1).Infof("WINSTON: Resuming %d unfinished downloads from %s\n", len(items), *stateFile)
+	return
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+// Sets the -state_file flag for the test
+func setStateFile(t *testing.T, path string) {
+	previous := stateFile
+	stateFile = &path
+	t.Cleanup(func() { stateFile = previous })
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	setStateFile(t, path)
+
+	first, err := metadata.ParseMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=First&tr=udp%3A%2F%2Ftracker.example.org%3A80")
+	if err != nil {
+		t.Fatalf("Could not parse the magnet link: %s", err)
+	}
+	second, err := metadata.ParseMagnet("76543210fedcba9876543210fedcba9876543210")
+	if err != nil {
+		t.Fatalf("Could not parse the infohash: %s", err)
+	}
+	pending := []metadata.PendingDownload{
+		{Magnet: first, Priority: 3, Added: time.Now()},
+		{Magnet: second, Added: time.Now()},
+	}
+	if err := saveState(pending); err != nil {
+		t.Fatalf("Could not save the state: %s", err)
+	}
+
+	items := loadState()
+	if len(items) != len(pending) {
+		t.Fatalf("Expected %d saved downloads, got %d", len(pending), len(items))
+	}
+	for i, item := range items {
+		if item.magnet.URI() != pending[i].Magnet.URI() || item.Priority != pending[i].Priority {
+			t.Errorf("Expected %s with priority %d, got %s with priority %d", pending[i].Magnet.URI(), pending[i].Priority, item.magnet.URI(), item.Priority)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("The temporary file was not removed: %v", err)
+	}
+
+	// Nothing is pending anymore, so there is nothing to resume
+	for i := 0; i < 2; i++ {
+		if err := saveState(nil); err != nil {
+			t.Fatalf("Could not save the empty state: %s", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected the state file to be removed, got %v", err)
+		}
+		if items := loadState(); len(items) != 0 {
+			t.Errorf("Expected no saved downloads, got %d", len(items))
+		}
+	}
+}
+
+func TestStateDisabled(t *testing.T) {
+	setStateFile(t, "")
+	magnet, err := metadata.ParseMagnet("0123456789abcdef0123456789abcdef01234567")
+	if err != nil {
+		t.Fatalf("Could not parse the infohash: %s", err)
+	}
+	if err := saveState([]metadata.PendingDownload{{Magnet: magnet}}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if items := loadState(); items != nil {
+		t.Errorf("Expected no saved downloads, got %d", len(items))
+	}
+}
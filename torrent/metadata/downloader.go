@@ -4,12 +4,15 @@
 package metadata
 
 import (
-	"fmt"
-	"os"
+	"context"
+	"net"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/na--/winston/torrent/peer"
+	"github.com/na--/winston/torrent/tracker"
 
 	log "github.com/golang/glog"
 
@@ -21,147 +24,525 @@ type downloadEventType int
 const (
 	eventSucessfulDownload downloadEventType = iota
 	eventTimeout
+	eventPeerFailed
+	eventPeersDiscovered
+	eventAborted
+)
+
+// When a torrent runs out of peers, the peer sources are asked for more after a
+// delay that doubles every time, until some new peers are tried
+const (
+	minRefreshDelay = 15 * time.Second
+	maxRefreshDelay = 5 * time.Minute
+)
+
+// PEX, the trackers and the DHT refreshes return mostly the same peers, the ones
+// that were already tried for a torrent are skipped until this delay has passed
+const peerRetryDelay = 2 * time.Minute
+
+// How many of the found peers are kept for every unfinished download, so they can
+// be tried first when the download is resumed after a shutdown
+const maxPendingPeers = 200
+
+const (
+	trackerNumWant = 100
+	// We don't know the size of the torrent, but claiming we have all of it
+	// would get us no seeds from the trackers
+	trackerLeft = 1
+	// Announced to trackers when we don't listen for incoming connections
+	defaultAnnouncePort = 6881
 )
 
 type downloadEvent struct {
 	infoHash  dht.InfoHash
 	eventType downloadEventType
+	peer      string   // The peer that the event is about, if any
+	err       error    // Why the peer or the download failed, for eventPeerFailed and eventAborted
+	peers     []string // New peers for the torrent, for eventPeersDiscovered
+	metadata  []byte   // The downloaded metadata, for eventSucessfulDownload
+	aliases   []string // Other infohashes of the same (hybrid) torrent, for eventSucessfulDownload
+	tried     int      // How many peers were tried, for the events that finish the download
 }
 
-// StartNewDownloadManager starts a new goroutine and returns 2 channels:
-// The first is used to pass torrent infohashes to the downloader;
-// The second is used by the downloader to signal when all the requested torrents
-// have been downloaded or have timed out.
-func StartNewDownloadManager() (chan<- string, <-chan bool) {
-	// Starts a DHT node with the default options, picks a random UDP port.
-	d, err := dht.New(nil)
-	if err != nil {
-		log.Errorf("WINSTON: New DHT error: %v\n", err)
-		os.Exit(1)
+// Information about a torrent that is currently being downloaded
+type download struct {
+	magnet      *Magnet
+	peers       chan []string
+	failedPeers int
+	firstPeer   time.Time // When the first peer was discovered
+	knownPeers  map[string]bool
+	started     bool // False while the download waits in the queue
+	priority    int
+	ctx         context.Context
+	cancel      context.CancelFunc // Stops the downloadFile goroutine
+	handle      *Download
+}
+
+// The outcome of a single peer worker
+type peerResult struct {
+	peer    string
+	torrent []byte
+	err     error
+}
+
+// The main loop of the Manager, it's the only goroutine that accesses the downloads
+func (m *Manager) run() {
+	currentDownloads := make(map[dht.InfoHash]*download)
+	var waiters []chan struct{}
+	var queue []dht.InfoHash // Downloads that wait for a free slot
+	activeDownloads := 0
+
+	startDownload := func(infoHash dht.InfoHash) {
+		newDownload := currentDownloads[infoHash]
+		newDownload.started = true
+		newDownload.handle.started = time.Now()
+		activeDownloads++
+
+		bufferedPeerChannel := makePeerBuffer(newDownload.peers)
+
+		// The peers from the magnet link are tried first
+		if len(newDownload.magnet.Peers) > 0 {
+			newDownload.firstPeer = time.Now()
+			newDownload.peers <- newDownload.magnet.Peers
+		}
+
+		// Create a new gorouite that manages the download for the specific file
+		go m.downloadFile(newDownload.ctx, newDownload.magnet, bufferedPeerChannel)
 	}
 
-	go d.Run()
+	startQueued := func() {
+		for len(queue) > 0 && (m.options.MaxConcurrentDownloads <= 0 || activeDownloads < m.options.MaxConcurrentDownloads) {
+			next := queue[0]
+			queue = queue[1:]
+			// Queued downloads can be finished before they are started, e.g. if they were aborted
+			if queued, ok := currentDownloads[next]; ok && !queued.started {
+				startDownload(next)
+			}
+		}
+	}
 
-	time.Sleep(7 * time.Second) //TODO: this seems to be necessary; remove after investigating the DHT lib
+	// Completes the download and notifies everyone who is interested
+	finishDownload := func(infoHash dht.InfoHash, result Result) {
+		currentDownload := currentDownloads[infoHash]
+		currentDownload.cancel()
+		close(currentDownload.peers)
+		delete(currentDownloads, infoHash)
+		if currentDownload.started {
+			activeDownloads--
+		}
 
-	filesToDownload := make(chan string)
-	finished := make(chan bool)
+		handle := currentDownload.handle
+		result.InfoHash = string(infoHash)
+		result.Magnet = handle.magnet
+		if currentDownload.started {
+			result.QueueTime = handle.started.Sub(handle.added)
+			result.Duration = time.Since(handle.started)
+			if !currentDownload.firstPeer.IsZero() {
+				result.FirstPeer = currentDownload.firstPeer.Sub(handle.started)
+			}
+		} else {
+			result.QueueTime = time.Since(handle.added)
+		}
+		if result.PeersTried < currentDownload.failedPeers {
+			result.PeersTried = currentDownload.failedPeers
+		}
+		if result.Err == nil && result.Metadata != nil {
+			result.Path = SavedMetadata{m.options.OutputFolder}.Path(string(infoHash))
+		}
+		handle.result = result
+		close(handle.done)
 
-	go downloadManager(d, filesToDownload, finished)
+		if atomic.LoadInt32(&m.subscribed) != 0 {
+			m.resultsIn <- result
+		}
 
-	return filesToDownload, finished
-}
+		if len(currentDownloads) == 0 {
+			for _, waiter := range waiters {
+				close(waiter)
+			}
+			waiters = nil
+		}
+	}
 
-func downloadManager(d *dht.DHT, filesToDownload <-chan string, finished chan<- bool) {
-	currentDownloads := make(map[dht.InfoHash]chan []string)
-	downloadEvents := make(chan downloadEvent)
+	// Remembers the peers of the download, up to maxPendingPeers
+	addKnownPeers := func(currentDownload *download, peers []string) {
+		for _, p := range peers {
+			if len(currentDownload.knownPeers) >= maxPendingPeers {
+				return
+			}
+			currentDownload.knownPeers[p] = true
+		}
+	}
+
+	// Once draining, no downloads are started and drained is closed when the active ones are finished
+	drainSignal := m.draining
+	draining, drained := false, false
+	checkDrained := func() {
+		if draining && !drained && activeDownloads == 0 {
+			close(m.drained)
+			drained = true
+		}
+	}
+
+	defer close(m.loopDone)
+	defer close(m.resultsIn)
 
 	for {
 		select {
-		case newInfoHashString := <-filesToDownload:
-			newFile, err := dht.DecodeInfoHash(newInfoHashString)
-			if err != nil {
-				//TODO: better error handling
-				log.Errorf("WINSTON: DecodeInfoHash error: %v\n", err)
-			}
-
-			if _, ok := currentDownloads[newFile]; ok {
-				log.V(3).Infof("WINSTON: File %x is already downloading, skipping...\n", newFile)
-				continue
+		case <-m.closed:
+			for infoHash, currentDownload := range currentDownloads {
+				magnet := *currentDownload.magnet
+				magnet.Peers = nil
+				for p := range currentDownload.knownPeers {
+					magnet.Peers = append(magnet.Peers, p)
+				}
+				sort.Strings(magnet.Peers)
+				m.pending = append(m.pending, PendingDownload{&magnet, currentDownload.priority, currentDownload.handle.added})
+				finishDownload(infoHash, Result{Err: ErrManagerClosed})
 			}
-			log.V(3).Infof("WINSTON: Accepted %x for download...\n", newFile)
+			sort.SliceStable(m.pending, func(i, j int) bool {
+				if m.pending[i].Priority != m.pending[j].Priority {
+					return m.pending[i].Priority > m.pending[j].Priority
+				}
+				return m.pending[i].Added.Before(m.pending[j].Added)
+			})
+			return
 
-			// Create a channel for all the found peers
-			currentDownloads[newFile] = make(chan []string)
+		case <-drainSignal:
+			log.V(1).Infof("WINSTON: Shutting down, waiting for %d active downloads to finish...\n", activeDownloads)
+			draining = true
+			drainSignal = nil
+			checkDrained()
 
-			bufferedPeerChannel := makePeerBuffer(currentDownloads[newFile])
+		case waiter := <-m.waitRequests:
+			if len(currentDownloads) == 0 {
+				close(waiter)
+			} else {
+				waiters = append(waiters, waiter)
+			}
 
-			// Ask that nice DHT fellow to find those peers :)
-			d.PeersRequest(string(newFile), false)
+		case request := <-m.requests:
+			if draining {
+				request.reply <- nil
+				continue
+			}
+			magnet := request.magnet
+			newFile := dht.InfoHash(magnet.InfoHash)
 
-			// Create a new gorouite that manages the download for the specific file
-			go downloadFile(newFile, bufferedPeerChannel, downloadEvents)
+			if existing, ok := currentDownloads[newFile]; ok {
+				log.V(3).Infof("WINSTON: File %s is already downloading, skipping...\n", magnet)
+				request.reply <- existing.handle
+				continue
+			}
+			log.V(3).Infof("WINSTON: Accepted %s for download...\n", magnet)
 
-		case newEvent := <-downloadEvents:
-			if newEvent.eventType == eventSucessfulDownload {
-				log.V(1).Infof("WINSTON: Download of %x completed :)\n", newEvent.infoHash)
-			} else if newEvent.eventType == eventTimeout {
-				log.V(1).Infof("WINSTON: Download of %x failed: time out :(\n", newEvent.infoHash)
+			// Create a channel for all the found peers
+			ctx, cancel := context.WithCancel(m.ctx)
+			newDownload := &download{
+				magnet:     magnet,
+				peers:      make(chan []string),
+				priority:   request.priority,
+				ctx:        ctx,
+				knownPeers: make(map[string]bool),
+				cancel:     cancel,
+				handle:     &Download{magnet: magnet, added: time.Now(), done: make(chan struct{})},
 			}
-			close(currentDownloads[newEvent.infoHash])
-			delete(currentDownloads, newEvent.infoHash)
-			if len(currentDownloads) == 0 {
-				finished <- true
+			currentDownloads[newFile] = newDownload
+			request.reply <- newDownload.handle
+			addKnownPeers(newDownload, magnet.Peers)
+
+			// After all the queued downloads with the same or higher priority
+			position := len(queue)
+			for i, queued := range queue {
+				if other, ok := currentDownloads[queued]; ok && other.priority < request.priority {
+					position = i
+					break
+				}
+			}
+			queue = append(queue[:position], append([]dht.InfoHash{newFile}, queue[position:]...)...)
+			startQueued()
+			if !newDownload.started {
+				log.V(2).Infof("WINSTON: %d downloads are active, %s will wait in the queue\n", activeDownloads, magnet)
 			}
 
-		case newPeers, chanOk := <-d.PeersRequestResults:
-			if !chanOk {
-				// Something went wrong, mayday, mayday!
-				panic("WINSTON: BORK!\n")
+			// The caller can abort the download by cancelling their context
+			go func() {
+				select {
+				case <-request.ctx.Done():
+					select {
+					case m.events <- downloadEvent{infoHash: newFile, eventType: eventAborted, err: request.ctx.Err()}:
+					case <-ctx.Done():
+					}
+				case <-ctx.Done():
+				}
+			}()
+
+		case newEvent := <-m.events:
+			currentDownload, ok := currentDownloads[newEvent.infoHash]
+			if !ok {
+				// The download was already finished, e.g. via another infohash of the same hybrid torrent
+				continue
 			}
 
-			for ih, peers := range newPeers {
-				// Check if download is still active
-				if currentPeersChan, ok := currentDownloads[ih]; ok {
-					log.V(3).Infof("WINSTON: Received %d new peers for file %x\n", len(peers), ih)
-					currentPeersChan <- peers
-				} else {
-					log.V(3).Infof("WINSTON: Received %d peers for non-current file %x (probably completed or timed out)\n", len(peers), ih)
+			if newEvent.eventType == eventPeersDiscovered {
+				// All the peer sources feed the same buffer
+				log.V(3).Infof("WINSTON: Discovered %d new peers for file %x\n", len(newEvent.peers), newEvent.infoHash)
+				if currentDownload.firstPeer.IsZero() && len(newEvent.peers) > 0 {
+					currentDownload.firstPeer = time.Now()
+				}
+				addKnownPeers(currentDownload, newEvent.peers)
+				currentDownload.peers <- newEvent.peers
+			} else if newEvent.eventType == eventPeerFailed {
+				currentDownload.failedPeers++
+				log.V(3).Infof("WINSTON: Peer %s failed for %s (%d failed peers so far): %s\n", newEvent.peer, currentDownload.magnet, currentDownload.failedPeers, newEvent.err)
+			} else if newEvent.eventType == eventSucessfulDownload {
+				log.V(1).Infof("WINSTON: Download of %s completed from %s after %d failed peers :)\n", currentDownload.magnet, newEvent.peer, currentDownload.failedPeers)
+				result := Result{Metadata: newEvent.metadata, Peer: newEvent.peer, PeersTried: newEvent.tried}
+				finishDownload(newEvent.infoHash, result)
+
+				// A hybrid torrent satisfies both its v1 and v2 infohashes
+				for _, alias := range newEvent.aliases {
+					if aliasDownload, ok := currentDownloads[dht.InfoHash(alias)]; ok {
+						log.V(1).Infof("WINSTON: Download of %s completed as well, it's the same hybrid torrent :)\n", aliasDownload.magnet)
+						finishDownload(dht.InfoHash(alias), result)
+					}
 				}
+			} else if newEvent.eventType == eventTimeout {
+				log.V(1).Infof("WINSTON: Download of %s failed: time out after %d failed peers :(\n", currentDownload.magnet, currentDownload.failedPeers)
+				finishDownload(newEvent.infoHash, Result{PeersTried: newEvent.tried, Err: ErrDownloadTimeout})
+			} else if newEvent.eventType == eventAborted {
+				log.V(1).Infof("WINSTON: Download of %s was aborted: %s\n", currentDownload.magnet, newEvent.err)
+				finishDownload(newEvent.infoHash, Result{Metadata: newEvent.metadata, Peer: newEvent.peer, PeersTried: newEvent.tried, Err: newEvent.err})
+			}
+
+			// Finished downloads free up slots for the queued ones
+			if draining {
+				checkDrained()
+			} else {
+				startQueued()
 			}
 		}
 	}
 }
 
-func downloadFile(infoHash dht.InfoHash, peerChannel <-chan string, eventsChannel chan<- downloadEvent) {
-	//TODO: implement
-	//TODO: get peers from buffered channel, connect to them, download torrent file
-	//TODO: add some sure way to detect goroutine finished (defer send to channel?)
+// Downloads the metadata for a single torrent until it's complete, it times out or
+// ctx is cancelled. Events are sent only while ctx is not done.
+func (m *Manager) downloadFile(ctx context.Context, magnet *Magnet, peerChannel <-chan string) {
+	infoHash := dht.InfoHash(magnet.InfoHash)
+	maxPeers := m.options.MaxPeersPerDownload
 	peerCount := 0
+	triedPeers := 0 // Without the skipped ones
+	activePeers := 0
+	// When every peer was tried for the last time, zero while it's still being tried
+	triedAt := make(map[string]time.Time)
+	// Every worker sends exactly one result, so a buffer of maxPeers means
+	// that no worker will be left blocked after this function returns
+	results := make(chan peerResult, maxPeers)
+
+	// Used to abort all active workers once the download is over
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The manager stops listening for our events once the download is finished
+	sendEvent := func(event downloadEvent) {
+		select {
+		case m.events <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	// All workers share their metadata pieces, so that nothing is lost when a peer drops
+	assembler := peer.NewMetadataAssembler(magnet.fullInfoHash(), &m.options.Peer)
+
+	// Peers that connect to us for this torrent can contribute pieces as well
+	if m.listener != nil {
+		m.listener.Want(string(infoHash), assembler)
+		defer m.listener.Unwant(string(infoHash))
+	}
+
+	sourcePeers := m.peerSource.FindPeers(ctx, string(infoHash))
+
+	// The peers of hybrid torrents can be found under their v2 infohash as well,
+	// it's truncated the same way as for v2-only magnet links
+	var v2InfoHash string
+	var v2SourcePeers <-chan []string
+	if magnet.InfoHashV2 != "" && magnet.InfoHashV2[:sha1Size] != magnet.InfoHash {
+		v2InfoHash = magnet.InfoHashV2[:sha1Size]
+		v2SourcePeers = m.peerSource.FindPeers(ctx, v2InfoHash)
+	}
+
+	// Get more peers from the trackers, if there are any
+	trackerPeers := make(chan []string)
+	announce := tracker.AnnounceRequest{
+		InfoHash: string(infoHash),
+		Port:     defaultAnnouncePort,
+		Left:     trackerLeft,
+		NumWant:  trackerNumWant,
+	}
+	if m.listener != nil {
+		if addr, ok := m.listener.Addr().(*net.TCPAddr); ok {
+			announce.Port = uint16(addr.Port)
+		}
+	}
+	trackerList := append(append([]string(nil), m.options.Trackers...), magnet.Trackers...)
+	for _, trackerURL := range trackerList {
+		go tracker.AnnounceLoop(ctx, trackerURL, announce, trackerPeers)
+	}
+
+	// Ask for more peers periodically if we run out of them
+	refresher, canRefresh := m.peerSource.(PeerRefresher)
+	refreshDelay := minRefreshDelay
+	refreshTimer := time.NewTimer(refreshDelay)
+	defer refreshTimer.Stop()
+	attemptsSinceRefresh := 0
+
 	tick := time.Tick(10 * time.Second)
-	timeout := time.After(10 * time.Minute)
+	timeout := time.After(m.options.DownloadTimeout)
 
 	for {
+		// Only accept new peers while there are free worker slots
+		var newPeers <-chan string
+		if activePeers < maxPeers {
+			newPeers = peerChannel
+		}
+
 		select {
-		case newPeer, chanOk := <-peerChannel:
+		case peerStr, chanOk := <-newPeers:
 			if !chanOk {
 				log.V(2).Infof("WINSTON: Peer channel for %x was closed, probably by torrent timeout. Killing download goroutine...\n", infoHash)
 				return
 			}
 
 			peerCount++
-			peerStr := dht.DecodePeerAddress(newPeer)
 			if strings.HasSuffix(peerStr, ":1") {
 				log.V(3).Infof("WINSTON: Skipping peer #%d for torrent %x for looking fake: %s\n", peerCount, infoHash, peerStr)
 				continue
 			}
+			if assembler.IsBlacklisted(peerStr) {
+				log.V(3).Infof("WINSTON: Skipping peer #%d for torrent %x because it sent bad metadata: %s\n", peerCount, infoHash, peerStr)
+				continue
+			}
+			if lastTry, ok := triedAt[peerStr]; ok && (lastTry.IsZero() || time.Since(lastTry) < peerRetryDelay) {
+				log.V(3).Infof("WINSTON: Skipping peer #%d for torrent %x because it was already tried: %s\n", peerCount, infoHash, peerStr)
+				continue
+			}
+			triedAt[peerStr] = time.Time{}
+
+			log.V(3).Infof("WINSTON: Peer #%d received for torrent %x: %s (%d active peers)\n", peerCount, infoHash, peerStr, activePeers)
+
+			attemptsSinceRefresh++
+			triedPeers++
+			activePeers++
+			go func() {
+				// Wait for a free connection slot, if they are limited for all downloads
+				if m.peerSlots != nil {
+					select {
+					case m.peerSlots <- struct{}{}:
+						defer func() { <-m.peerSlots }()
+					case <-ctx.Done():
+						results <- peerResult{peerStr, nil, ctx.Err()}
+						return
+					}
+				}
+				torrent, err := assembler.DownloadFromPeer(ctx, peerStr)
+				results <- peerResult{peerStr, torrent, err}
+			}()
+
+		case result := <-results:
+			activePeers--
+			triedAt[result.peer] = time.Now()
+
+			if result.err != nil {
+				log.V(1).Infof("WINSTON: Torrent %x was not downloaded from %s (%s), trying again...\n", infoHash, result.peer, result.err)
+				sendEvent(downloadEvent{infoHash: infoHash, eventType: eventPeerFailed, peer: result.peer, err: result.err})
+				continue
+			}
 
-			log.V(3).Infof("WINSTON: Peer #%d received for torrent %x: %s\n", peerCount, infoHash, peerStr)
+			// The worker's peer may not have sent any pieces, if the metadata was completed by another one
+			m.completeDownload(magnet, result.torrent, assembler.CompletedBy(), triedPeers, sendEvent)
+			return
 
-			//TODO: run as paralel goroutines
-			//TODO: taka care to have N parallel downloaders at all times, if possible
-			//TODO: send requests for more peers periodically
-			//TODO: gather results and stop everything once a successful result has been found
-			torrent := peer.DownloadMetadataFromPeer(peerStr, string(infoHash))
-			if torrent != nil {
-				log.V(1).Infof("WINSTON: Torrent %x really was downloaded!\n", infoHash)
-				err := saveMetaInfo(string(infoHash), torrent)
-				if err != nil {
-					panic(fmt.Errorf("Could not save a simple file: %s", err))
+		case pexPeers := <-assembler.DiscoveredPeers():
+			// Seeds are tried first, they surely have the metadata
+			var seeds, others []string
+			for _, p := range pexPeers {
+				if p.Flags&peer.PexSeed != 0 {
+					seeds = append(seeds, p.Address)
+				} else {
+					others = append(others, p.Address)
 				}
-				eventsChannel <- downloadEvent{infoHash, eventSucessfulDownload}
-				return
 			}
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventPeersDiscovered, peers: append(seeds, others...)})
+
+		case newPeers, chanOk := <-sourcePeers:
+			if !chanOk {
+				sourcePeers = nil
+				continue
+			}
+			log.V(3).Infof("WINSTON: Received %d new peers for file %x\n", len(newPeers), infoHash)
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventPeersDiscovered, peers: newPeers})
+
+		case newPeers, chanOk := <-v2SourcePeers:
+			if !chanOk {
+				v2SourcePeers = nil
+				continue
+			}
+			log.V(3).Infof("WINSTON: Received %d new peers for file %x under its v2 infohash\n", len(newPeers), infoHash)
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventPeersDiscovered, peers: newPeers})
+
+		case newPeers := <-trackerPeers:
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventPeersDiscovered, peers: newPeers})
+
+		case <-assembler.Done():
+			// The metadata was completed by a peer that connected to us
+			m.completeDownload(magnet, assembler.Metadata(), assembler.CompletedBy(), triedPeers, sendEvent)
+			return
 
-			log.V(1).Infof("WINSTON: Torrent %x was not downloaded, trying again...\n", infoHash)
+		case <-refreshTimer.C:
+			if canRefresh && activePeers < maxPeers && attemptsSinceRefresh < maxPeers {
+				log.V(3).Infof("WINSTON: Only %d peers were tried for %x in the last %s, asking for more...\n", attemptsSinceRefresh, infoHash, refreshDelay)
+				refresher.RefreshPeers(string(infoHash))
+				if v2InfoHash != "" {
+					refresher.RefreshPeers(v2InfoHash)
+				}
+				refreshDelay *= 2
+				if refreshDelay > maxRefreshDelay {
+					refreshDelay = maxRefreshDelay
+				}
+			} else {
+				refreshDelay = minRefreshDelay
+			}
+			attemptsSinceRefresh = 0
+			refreshTimer.Reset(refreshDelay)
 
 		case <-tick:
-			log.V(3).Infof("WINSTON: Tick-tack %x...\n", infoHash)
+			log.V(3).Infof("WINSTON: Tick-tack %x (%d active peers)...\n", infoHash, activePeers)
 
 		case <-timeout:
 			log.V(3).Infof("WINSTON: Torrent %x timed out...\n", infoHash)
-			eventsChannel <- downloadEvent{infoHash, eventTimeout}
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventTimeout, tried: triedPeers})
+			return
+
+		case <-ctx.Done():
+			log.V(2).Infof("WINSTON: Download of %x was stopped, killing download goroutine...\n", infoHash)
+			return
+		}
+	}
+}
+
+func (m *Manager) completeDownload(magnet *Magnet, torrent []byte, fromPeer string, triedPeers int, sendEvent func(downloadEvent)) {
+	infoHash := dht.InfoHash(magnet.InfoHash)
+	log.V(1).Infof("WINSTON: Torrent %x really was downloaded from %s!\n", infoHash, fromPeer)
+
+	// Hybrid torrents are saved under both of their infohashes, so they can be served for either
+	aliases := metadataInfoHashes(torrent)
+	for _, alias := range aliases {
+		err := saveMetaInfo(m.options.OutputFolder, magnet.DisplayName, alias, torrent)
+		if err != nil {
+			log.Errorf("WINSTON: Could not save the metadata for %x: %s\n", infoHash, err)
+			sendEvent(downloadEvent{infoHash: infoHash, eventType: eventAborted, peer: fromPeer, metadata: torrent, err: err, tried: triedPeers})
 			return
 		}
 	}
+	sendEvent(downloadEvent{infoHash: infoHash, eventType: eventSucessfulDownload, peer: fromPeer, metadata: torrent, aliases: aliases, tried: triedPeers})
 }
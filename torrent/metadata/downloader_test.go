@@ -0,0 +1,295 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/na--/winston/torrent/peer"
+)
+
+// A PeerSource that returns the same batches of peers for every torrent
+type staticPeerSource [][]string
+
+func (s staticPeerSource) FindPeers(ctx context.Context, infoHash string) <-chan []string {
+	peers := make(chan []string)
+	go func() {
+		defer close(peers)
+		for _, batch := range s {
+			select {
+			case peers <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return peers
+}
+
+// Accepts connections and closes them immediately, returns the address and the
+// number of accepted connections
+func startRefusingPeer(t *testing.T) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+func TestDownloadSkipsTriedPeers(t *testing.T) {
+	address, accepted := startRefusingPeer(t)
+	other, otherAccepted := startRefusingPeer(t)
+
+	options := DefaultOptions()
+	options.OutputFolder = t.TempDir()
+	options.DownloadTimeout = time.Second
+	options.Peer.Encryption = peer.EncryptionDisabled
+	// Every source returns the same peer again
+	options.PeerSource = staticPeerSource{{address}, {address, other}, {other, address}}
+
+	m, err := NewManager(options)
+	if err != nil {
+		t.Fatalf("Could not create the manager: %s", err)
+	}
+	defer m.Close()
+
+	magnet := &Magnet{InfoHash: string(make([]byte, sha1Size)), Peers: []string{address}}
+	download, err := m.AddMagnet(context.Background(), magnet, 0)
+	if err != nil {
+		t.Fatalf("Could not add the download: %s", err)
+	}
+
+	result := download.Result()
+	if result.Err != ErrDownloadTimeout {
+		t.Errorf("Expected a timeout, got %v", result.Err)
+	}
+	if result.PeersTried != 2 {
+		t.Errorf("Expected 2 tried peers, got %d", result.PeersTried)
+	}
+	if count := atomic.LoadInt32(accepted) + atomic.LoadInt32(otherAccepted); count != 2 {
+		t.Errorf("Expected one connection to each peer, got %d", count)
+	}
+}
+
+// A PeerSource that records the lookups and returns peers only for some infohashes
+type recordingPeerSource struct {
+	peers   map[string][]string
+	lookups chan string
+}
+
+func (s *recordingPeerSource) FindPeers(ctx context.Context, infoHash string) <-chan []string {
+	s.lookups <- infoHash
+	return staticPeerSource{s.peers[infoHash]}.FindPeers(ctx, infoHash)
+}
+
+func TestHybridMagnetPeerLookups(t *testing.T) {
+	v1 := strings.Repeat("\x01", sha1Size)
+	v2 := strings.Repeat("\x02", sha256Size)
+
+	tests := []struct {
+		name        string
+		magnet      Magnet
+		wantLookups []string
+	}{
+		{"v1", Magnet{InfoHash: v1}, []string{v1}},
+		{"v2 only", Magnet{InfoHash: v2[:sha1Size], InfoHashV2: v2}, []string{v2[:sha1Size]}},
+		{"hybrid", Magnet{InfoHash: v1, InfoHashV2: v2}, []string{v1, v2[:sha1Size]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Only the last lookup returns the peer
+			address, accepted := startRefusingPeer(t)
+			source := &recordingPeerSource{
+				peers:   map[string][]string{test.wantLookups[len(test.wantLookups)-1]: {address}},
+				lookups: make(chan string, 10),
+			}
+			options := DefaultOptions()
+			options.OutputFolder = t.TempDir()
+			options.DownloadTimeout = 500 * time.Millisecond
+			options.Peer.Encryption = peer.EncryptionDisabled
+			options.PeerSource = source
+
+			m, err := NewManager(options)
+			if err != nil {
+				t.Fatalf("Could not create the manager: %s", err)
+			}
+			defer m.Close()
+
+			magnet := test.magnet
+			download, err := m.AddMagnet(context.Background(), &magnet, 0)
+			if err != nil {
+				t.Fatalf("Could not add the download: %s", err)
+			}
+			download.Result()
+
+			close(source.lookups)
+			var lookups []string
+			for infoHash := range source.lookups {
+				lookups = append(lookups, infoHash)
+			}
+			if !reflect.DeepEqual(lookups, test.wantLookups) {
+				t.Errorf("Expected lookups for %x, got %x", test.wantLookups, lookups)
+			}
+			if atomic.LoadInt32(accepted) != 1 {
+				t.Errorf("The peer that was found was not tried")
+			}
+		})
+	}
+}
+
+// Accepts connections and never answers, until they are closed
+func startSilentPeer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// A TCP dialer that counts the open connections
+type trackingDialer struct {
+	mu      sync.Mutex
+	open    int
+	maxOpen int
+}
+
+type trackedConn struct {
+	net.Conn
+	dialer *trackingDialer
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.dialer.mu.Lock()
+		c.dialer.open--
+		c.dialer.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (d *trackingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := peer.TCPDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.open++
+	if d.open > d.maxOpen {
+		d.maxOpen = d.open
+	}
+	d.mu.Unlock()
+	return &trackedConn{Conn: conn, dialer: d}, nil
+}
+
+func (d *trackingDialer) counts() (open, maxOpen int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.open, d.maxOpen
+}
+
+// Starts a peer that has the metadata, returns its address and the infohash
+func startSeed(t *testing.T, metadata []byte) (address string, infoHash string) {
+	folder := t.TempDir()
+	infoHash = metadataInfoHashes(metadata)[0]
+	if err := saveMetaInfo(folder, "", infoHash, metadata); err != nil {
+		t.Fatalf("Could not save the metadata: %s", err)
+	}
+	l, err := peer.Listen("127.0.0.1:0", SavedMetadata{folder}, nil)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go l.Serve(ctx)
+	return l.Addr().String(), infoHash
+}
+
+func TestDownloadPeerWorkers(t *testing.T) {
+	const maxPeers = 3
+	const handshakeTimeout = 500 * time.Millisecond
+	metadata := []byte("d6:lengthi1024e4:name4:test12:piece lengthi16384e6:pieces20:01234567890123456789e")
+	seed, infoHash := startSeed(t, metadata)
+
+	// The first wave of silent peers times out, the seed comes with the second one
+	var peers []string
+	for i := 0; i < 2*maxPeers-1; i++ {
+		peers = append(peers, startSilentPeer(t))
+	}
+	peers = append(peers, seed)
+
+	options := DefaultOptions()
+	options.OutputFolder = t.TempDir()
+	options.MaxPeersPerDownload = maxPeers
+	options.Peer.Encryption = peer.EncryptionDisabled
+	options.Peer.HandshakeTimeout = handshakeTimeout
+	dialer := &trackingDialer{}
+	options.Peer.Dialer = dialer
+	options.PeerSource = staticPeerSource{}
+
+	m, err := NewManager(options)
+	if err != nil {
+		t.Fatalf("Could not create the manager: %s", err)
+	}
+	defer m.Close()
+
+	download, err := m.AddMagnet(context.Background(), &Magnet{InfoHash: infoHash, Peers: peers}, 0)
+	if err != nil {
+		t.Fatalf("Could not add the download: %s", err)
+	}
+	result := download.Result()
+	if result.Err != nil || !bytes.Equal(result.Metadata, metadata) || result.Peer != seed {
+		t.Fatalf("Expected the metadata from %s, got %q from %s (%v)", seed, result.Metadata, result.Peer, result.Err)
+	}
+
+	// The other workers of the second wave are aborted, before their handshakes time out
+	deadline := time.Now().Add(handshakeTimeout / 2)
+	open, maxOpen := dialer.counts()
+	for open > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		open, maxOpen = dialer.counts()
+	}
+	if open > 0 {
+		t.Errorf("%d peer connections are still open after the download", open)
+	}
+	if maxOpen != maxPeers {
+		t.Errorf("Expected %d simultaneous connections, got %d", maxPeers, maxOpen)
+	}
+}
@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// TorrentInfo contains the most important fields of a torrent's info dictionary
+type TorrentInfo struct {
+	Name        string
+	PieceLength int64
+	TotalSize   int64
+	Files       []FileInfo // All files, a single one for single-file torrents
+	Private     bool
+	MetaVersion int      // 2 for v2 and hybrid torrents (BEP52), 1 otherwise
+	InfoHashes  []string // The raw infohashes, as they are used in the DHT and the peer protocols
+}
+
+// FileInfo is a single file in a torrent
+type FileInfo struct {
+	Path   string // Relative to the torrent's name for multi-file torrents
+	Length int64
+}
+
+// ParseInfo decodes the metadata (the info dictionary) of a v1, v2 or hybrid torrent
+func ParseInfo(metadata []byte) (info *TorrentInfo, err error) {
+	decoded, err := bencode.Decode(bytes.NewReader(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the metadata: %s", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The metadata is not a dictionary")
+	}
+
+	info = &TorrentInfo{MetaVersion: 1, InfoHashes: metadataInfoHashes(metadata)}
+	info.Name, _ = dict["name"].(string)
+	if name, ok := dict["name.utf-8"].(string); ok {
+		info.Name = name
+	}
+	info.PieceLength, _ = dict["piece length"].(int64)
+	if private, ok := dict["private"].(int64); ok && private == 1 {
+		info.Private = true
+	}
+	if version, ok := dict["meta version"].(int64); ok {
+		info.MetaVersion = int(version)
+	}
+
+	// Hybrid torrents have both the v1 file list and the v2 file tree, they should be the same
+	if files, ok := dict["files"].([]interface{}); ok {
+		for _, file := range files {
+			fileDict, ok := file.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Invalid file entry in the metadata")
+			}
+			length, _ := fileDict["length"].(int64)
+			pathParts, _ := fileDict["path"].([]interface{})
+			var parts []string
+			for _, part := range pathParts {
+				if s, ok := part.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+			info.Files = append(info.Files, FileInfo{path.Join(parts...), length})
+		}
+	} else if length, ok := dict["length"].(int64); ok {
+		info.Files = []FileInfo{{info.Name, length}}
+	} else if tree, ok := dict["file tree"].(map[string]interface{}); ok {
+		info.Files = walkFileTree(tree, "")
+	} else {
+		return nil, fmt.Errorf("The metadata has no files")
+	}
+
+	for _, file := range info.Files {
+		info.TotalSize += file.Length
+	}
+	return
+}
+
+// Lists the files in a v2 file tree, where every file is a dictionary with an empty key
+func walkFileTree(tree map[string]interface{}, prefix string) (files []FileInfo) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if fileDict, ok := node[""].(map[string]interface{}); ok {
+			length, _ := fileDict["length"].(int64)
+			files = append(files, FileInfo{path.Join(prefix, name), length})
+		} else {
+			files = append(files, walkFileTree(node, path.Join(prefix, name))...)
+		}
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package metadata
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	sha1Size   = 20
+	sha256Size = 32
+	// The multihash prefix of SHA-256 hashes: the function code and the digest length
+	multihashSHA256 = "\x12\x20"
+)
+
+// Magnet contains the information from a magnet link. Bare infohashes are
+// represented as magnet links with only the infohash set.
+type Magnet struct {
+	InfoHash    string   // The raw 20-byte infohash that is used in the DHT and peer protocols
+	InfoHashV2  string   // The raw 32-byte SHA-256 infohash of v2 torrents (BEP52), if any
+	DisplayName string   // The dn parameter, if any
+	Trackers    []string // The tr parameters
+	Peers       []string // The x.pe parameters, peers in the host:port format
+	WebSeeds    []string // The ws parameters
+}
+
+// Decodes a v1 infohash in hex (40 characters) or base32 (32 characters)
+func decodeBTIH(s string) (infoHash string, err error) {
+	var decoded []byte
+	switch len(s) {
+	case hex.EncodedLen(sha1Size):
+		decoded, err = hex.DecodeString(s)
+	case base32.StdEncoding.EncodedLen(sha1Size):
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("Expected 40 hex or 32 base32 characters, got %d", len(s))
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid infohash '%s': %s", s, err)
+		return
+	}
+	return string(decoded), nil
+}
+
+// Decodes a v2 infohash, which is a hex-encoded SHA-256 multihash
+func decodeBTMH(s string) (infoHash string, err error) {
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != len(multihashSHA256)+sha256Size || !strings.HasPrefix(string(decoded), multihashSHA256) {
+		err = fmt.Errorf("Invalid v2 infohash '%s'", s)
+		return
+	}
+	return string(decoded[len(multihashSHA256):]), nil
+}
+
+// ParseMagnet parses a magnet link or a bare v1 infohash in hex or base32.
+// For v2-only magnet links, InfoHash is the truncated v2 infohash, as that is
+// what the DHT and the peers use (BEP52).
+func ParseMagnet(input string) (m *Magnet, err error) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(strings.ToLower(input), "magnet:") {
+		infoHash, err := decodeBTIH(input)
+		if err != nil {
+			return nil, err
+		}
+		return &Magnet{InfoHash: infoHash}, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		err = fmt.Errorf("Invalid magnet link: %s", err)
+		return
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		err = fmt.Errorf("Invalid magnet link parameters: %s", err)
+		return
+	}
+
+	m = &Magnet{
+		DisplayName: params.Get("dn"),
+		Trackers:    params["tr"],
+		WebSeeds:    params["ws"],
+	}
+
+	for _, xt := range params["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:") && m.InfoHash == "":
+			m.InfoHash, err = decodeBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+		case strings.HasPrefix(xt, "urn:btmh:") && m.InfoHashV2 == "":
+			m.InfoHashV2, err = decodeBTMH(strings.TrimPrefix(xt, "urn:btmh:"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.InfoHash == "" {
+		if m.InfoHashV2 == "" {
+			return nil, fmt.Errorf("Magnet link has no BitTorrent infohash")
+		}
+		m.InfoHash = m.InfoHashV2[:sha1Size]
+	}
+
+	for _, p := range params["x.pe"] {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return nil, fmt.Errorf("Invalid peer '%s' in magnet link: %s", p, err)
+		}
+		m.Peers = append(m.Peers, p)
+	}
+
+	return
+}
+
+// Returns the infohash that the downloaded metadata is verified against, the full
+// v2 one for v2-only magnet links and the v1 one otherwise
+func (m *Magnet) fullInfoHash() string {
+	if m.InfoHashV2 != "" && m.InfoHash == m.InfoHashV2[:sha1Size] {
+		return m.InfoHashV2
+	}
+	return m.InfoHash
+}
+
+// String returns the hex infohash, followed by the display name if there is one
+func (m *Magnet) String() string {
+	if m.DisplayName == "" {
+		return fmt.Sprintf("%x", m.InfoHash)
+	}
+	return fmt.Sprintf("%x (%s)", m.InfoHash, m.DisplayName)
+}
+
+// URI returns the magnet link with all of the information in m, so that ParseMagnet
+// can parse it back
+func (m *Magnet) URI() string {
+	var params []string
+	add := func(name string, values ...string) {
+		for _, value := range values {
+			params = append(params, name+"="+url.QueryEscape(value))
+		}
+	}
+
+	// The v1 infohash of v2-only torrents is just the truncated v2 one
+	if m.InfoHashV2 == "" || m.InfoHash != m.InfoHashV2[:sha1Size] {
+		params = append(params, fmt.Sprintf("xt=urn:btih:%x", m.InfoHash))
+	}
+	if m.InfoHashV2 != "" {
+		params = append(params, fmt.Sprintf("xt=urn:btmh:%x%x", multihashSHA256, m.InfoHashV2))
+	}
+	if m.DisplayName != "" {
+		add("dn", m.DisplayName)
+	}
+	add("tr", m.Trackers...)
+	add("ws", m.WebSeeds...)
+	add("x.pe", m.Peers...)
+
+	return "magnet:?" + strings.Join(params, "&")
+}
@@ -0,0 +1,79 @@
+package metadata
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const (
+		hexHash    = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+		base32Hash = "YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK"
+		v2Hash     = "1d0c2b7a4c0a0eb15a9ef5b3b5d8c3b7a3d1e5f7c9b1a3d5e7f9a1b3c5d7e9f1"
+	)
+	v1 := "\xc1\x2f\xe1\xc0\x6b\xba\x25\x4a\x9d\xc9\xf5\x19\xb3\x35\xaa\x7c\x13\x67\xa8\x8a"
+	v2 := "\x1d\x0c\x2b\x7a\x4c\x0a\x0e\xb1\x5a\x9e\xf5\xb3\xb5\xd8\xc3\xb7\xa3\xd1\xe5\xf7\xc9\xb1\xa3\xd5\xe7\xf9\xa1\xb3\xc5\xd7\xe9\xf1"
+
+	tests := []struct {
+		name    string
+		input   string
+		want    *Magnet
+		wantErr bool
+	}{
+		{"bare hex", hexHash, &Magnet{InfoHash: v1}, false},
+		{"bare uppercase hex", " " + strings.ToUpper(hexHash) + "\n", &Magnet{InfoHash: v1}, false},
+		{"bare base32", base32Hash, &Magnet{InfoHash: v1}, false},
+		{"bare lowercase base32", strings.ToLower(base32Hash), &Magnet{InfoHash: v1}, false},
+		{"hex", "magnet:?xt=urn:btih:" + hexHash, &Magnet{InfoHash: v1}, false},
+		{"base32", "magnet:?xt=urn:btih:" + base32Hash, &Magnet{InfoHash: v1}, false},
+		{
+			"all parameters",
+			"magnet:?xt=urn:btih:" + hexHash + "&dn=Some+Torrent%20%C3%A9&tr=udp%3A%2F%2Ftracker.example.org%3A1337&tr=http://t2.example.org/announce" +
+				"&ws=http%3A%2F%2Fseed.example.org%2Ffile&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:51413",
+			&Magnet{
+				InfoHash:    v1,
+				DisplayName: "Some Torrent é",
+				Trackers:    []string{"udp://tracker.example.org:1337", "http://t2.example.org/announce"},
+				Peers:       []string{"10.0.0.1:6881", "[2001:db8::1]:51413"},
+				WebSeeds:    []string{"http://seed.example.org/file"},
+			},
+			false,
+		},
+		{"v2 only", "magnet:?xt=urn:btmh:1220" + v2Hash, &Magnet{InfoHash: v2[:sha1Size], InfoHashV2: v2}, false},
+		{"hybrid", "magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1220" + v2Hash, &Magnet{InfoHash: v1, InfoHashV2: v2}, false},
+		{"other xt parameters", "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + hexHash, &Magnet{InfoHash: v1}, false},
+		{"short hex", hexHash[:39], nil, true},
+		{"invalid hex", "z" + hexHash[1:], nil, true},
+		{"invalid base32", "1" + base32Hash[1:], nil, true},
+		{"no infohash", "magnet:?dn=test", nil, true},
+		{"invalid btih", "magnet:?xt=urn:btih:1234", nil, true},
+		{"btmh with another hash function", "magnet:?xt=urn:btmh:1320" + v2Hash, nil, true},
+		{"short btmh", "magnet:?xt=urn:btmh:1220" + v2Hash[:62], nil, true},
+		{"invalid peer", "magnet:?xt=urn:btih:" + hexHash + "&x.pe=10.0.0.1", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := ParseMagnet(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %+v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(m, test.want) {
+				t.Errorf("Expected %+v, got %+v", test.want, m)
+			}
+
+			// URI returns an equivalent magnet link
+			parsed, err := ParseMagnet(m.URI())
+			if err != nil || !reflect.DeepEqual(parsed, m) {
+				t.Errorf("URI %s was parsed as %+v (%v)", m.URI(), parsed, err)
+			}
+		})
+	}
+}
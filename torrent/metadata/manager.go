@@ -0,0 +1,331 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/na--/winston/torrent/peer"
+
+	log "github.com/golang/glog"
+
+	"github.com/nictuku/dht"
+)
+
+var (
+	// ErrDownloadTimeout is the result error for torrents whose metadata could not be downloaded in time
+	ErrDownloadTimeout = errors.New("Metadata download timed out")
+	// ErrManagerClosed is returned for downloads that were aborted because the Manager was closed
+	ErrManagerClosed = errors.New("Download manager was closed")
+)
+
+// Result is the outcome of the metadata download for a single torrent
+type Result struct {
+	InfoHash   string        // The raw 20-byte infohash that was used for the download
+	Magnet     *Magnet       // What was passed to Manager.Add
+	Metadata   []byte        // The verified metadata (the info dictionary), nil if the download failed
+	Path       string        // Where the torrent file was saved, if the download was successful
+	Peer       string        // The peer that completed the metadata, if any
+	PeersTried int           // How many peers we tried to download the metadata from
+	QueueTime  time.Duration // How long the download waited for a free slot
+	FirstPeer  time.Duration // From the start of the download until the first peer was found, 0 if none was
+	Duration   time.Duration // How long the download took, without the time in the queue
+	Err        error         // Why the download failed, nil if it was successful
+}
+
+// PendingDownload is a download that was not finished when the Manager was closed
+type PendingDownload struct {
+	Magnet   *Magnet // With the peers that were found for the torrent, so they can be tried first when it's resumed
+	Priority int
+	Added    time.Time
+}
+
+// Download is a handle for a torrent that was added to the Manager
+type Download struct {
+	magnet  *Magnet
+	added   time.Time
+	started time.Time
+	done    chan struct{}
+	result  Result
+}
+
+// Magnet returns the parsed infohash or magnet link of the torrent
+func (d *Download) Magnet() *Magnet {
+	return d.magnet
+}
+
+// Done returns a channel that is closed once the download is finished
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+// Result waits for the download to finish and returns its outcome
+func (d *Download) Result() Result {
+	<-d.done
+	return d.result
+}
+
+type addRequest struct {
+	ctx      context.Context
+	magnet   *Magnet
+	priority int
+	reply    chan *Download
+}
+
+// Manager downloads the metadata of multiple torrents in parallel, using the DHT,
+// trackers, Peer Exchange and incoming connections to find peers that have it.
+// All of its methods are safe for concurrent use.
+type Manager struct {
+	options    Options
+	peerSource PeerSource
+	ownDHT     *dht.DHT       // The DHT node that the manager started itself, if any
+	dhtSource  *DHTPeerSource // The peer source of ownDHT
+	listener   *peer.Listener
+
+	// Used to abort all downloads when the manager is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	requests     chan addRequest
+	waitRequests chan chan struct{}
+	events       chan downloadEvent
+	closed       chan struct{}
+	loopDone     chan struct{}
+	closeOnce    sync.Once
+	draining     chan struct{} // Closed by Shutdown
+	drained      chan struct{} // Closed once no downloads are active after draining
+	drainOnce    sync.Once
+	pending      []PendingDownload // Written by the event loop before loopDone is closed
+
+	// Limits the peer connections of all downloads, nil if there is no limit
+	peerSlots chan struct{}
+
+	subscribed int32 // Set when somebody is reading the results
+	resultsIn  chan Result
+	results    <-chan Result
+}
+
+// NewManager creates a Manager with the specified options, DefaultOptions() if
+// nil. If options.ListenAddress is set, it starts a listener for incoming peer
+// connections and fails if it can't. If options.PeerSource is nil, a new DHT
+// node with the default configuration is started and it is stopped when the
+// manager is closed. The returned Manager has to be closed with Close when it's no longer needed.
+func NewManager(options *Options) (m *Manager, err error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	// A copy, so the caller can't change the options of the running manager
+	opts := *options
+	opts.Trackers = append([]string(nil), options.Trackers...)
+	if opts.MaxPeersPerDownload <= 0 {
+		opts.MaxPeersPerDownload = defaultMaxPeersPerDownload
+	}
+	if opts.DownloadTimeout <= 0 {
+		opts.DownloadTimeout = defaultDownloadTimeout
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.MinRetryDelay <= 0 {
+		opts.MinRetryDelay = defaultMinRetryDelay
+	}
+	if opts.MaxRetryDelay <= 0 {
+		opts.MaxRetryDelay = defaultMaxRetryDelay
+	}
+
+	m = &Manager{
+		options:      opts,
+		peerSource:   opts.PeerSource,
+		requests:     make(chan addRequest),
+		waitRequests: make(chan chan struct{}),
+		events:       make(chan downloadEvent),
+		closed:       make(chan struct{}),
+		loopDone:     make(chan struct{}),
+		draining:     make(chan struct{}),
+		drained:      make(chan struct{}),
+		resultsIn:    make(chan Result),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.results = makeResultBuffer(m.resultsIn)
+	if opts.MaxPeerConnections > 0 {
+		m.peerSlots = make(chan struct{}, opts.MaxPeerConnections)
+	}
+
+	// Accept incoming peer connections, if enabled, both for serving metadata
+	// that we have and for downloading the metadata for torrents we want. This
+	// is done first, so a bad address fails without waiting for the DHT.
+	if opts.ListenAddress != "" {
+		listener, err := peer.Listen(opts.ListenAddress, SavedMetadata{opts.OutputFolder}, &m.options.Peer)
+		if err != nil {
+			// The user asked for it, so we don't run without it
+			m.cancel()
+			close(m.resultsIn)
+			return nil, fmt.Errorf("Could not listen on %s: %w", opts.ListenAddress, err)
+		}
+		log.V(1).Infof("WINSTON: Listening for incoming peers on %s\n", listener.Addr())
+		m.listener = listener
+		go listener.Serve(m.ctx)
+	}
+
+	if m.peerSource == nil {
+		// Starts a DHT node with the default options, picks a random UDP port.
+		ownDHT, err := dht.New(nil)
+		if err != nil {
+			m.cancel()
+			close(m.resultsIn)
+			if m.listener != nil {
+				m.listener.Close()
+			}
+			return nil, fmt.Errorf("Could not create a DHT node: %s", err)
+		}
+		dhtSource := NewDHTPeerSource(ownDHT, opts.DHTMinNodes)
+		go ownDHT.Run()
+
+		// Downloads can be added before the DHT is ready, but there is no point in
+		// starting them too early, since the peer lookups would be repeated anyway
+		bootstrapCtx, cancel := context.WithTimeout(context.Background(), opts.DHTBootstrapTimeout)
+		if !dhtSource.WaitReady(bootstrapCtx) {
+			log.V(1).Infof("WINSTON: DHT has only %d nodes after %s, continuing anyway\n", dhtSource.NodeCount(), opts.DHTBootstrapTimeout)
+		}
+		cancel()
+		m.ownDHT = ownDHT
+		m.dhtSource = dhtSource
+		m.peerSource = dhtSource
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// Add starts downloading the metadata for the infohash or magnet link. If the
+// torrent is already being downloaded, the existing handle is returned. The
+// download is aborted when ctx is cancelled.
+func (m *Manager) Add(ctx context.Context, input string) (*Download, error) {
+	magnet, err := ParseMagnet(input)
+	if err != nil {
+		return nil, err
+	}
+	return m.AddMagnet(ctx, magnet, 0)
+}
+
+// AddMagnet is the same as Add, but for an already parsed magnet link. When the
+// number of concurrent downloads is limited, the queued downloads with a higher
+// priority are started first.
+func (m *Manager) AddMagnet(ctx context.Context, magnet *Magnet, priority int) (*Download, error) {
+	request := addRequest{ctx, magnet, priority, make(chan *Download, 1)}
+	select {
+	case m.requests <- request:
+		// No handle is returned while the manager is shutting down
+		if download := <-request.reply; download != nil {
+			return download, nil
+		}
+		return nil, ErrManagerClosed
+	case <-m.draining:
+		return nil, ErrManagerClosed
+	case <-m.closed:
+		return nil, ErrManagerClosed
+	}
+}
+
+// Results returns a channel with the outcomes of all downloads, in the order they
+// finished. Only the results of the downloads that finish after the first call
+// are sent. The channel is closed when the Manager is closed and it should be
+// read until then, since the undelivered results are kept in memory.
+func (m *Manager) Results() <-chan Result {
+	atomic.StoreInt32(&m.subscribed, 1)
+	return m.results
+}
+
+// Wait blocks until all the added downloads are finished or the Manager is closed
+func (m *Manager) Wait() {
+	done := make(chan struct{})
+	select {
+	case m.waitRequests <- done:
+		select {
+		case <-done:
+		case <-m.closed:
+		}
+	case <-m.closed:
+	}
+}
+
+// Close aborts all unfinished downloads, their results have ErrManagerClosed as
+// the error. It also stops the listener for incoming peers and the DHT node, if
+// the manager started it, and closes the peer dialer if it's an io.Closer.
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		<-m.loopDone
+		m.cancel()
+		if m.ownDHT != nil {
+			m.dhtSource.Stop()
+			m.ownDHT.Stop()
+		}
+		if m.listener != nil {
+			m.listener.Close()
+		}
+		// E.g. the UDP socket of the uTP transport
+		if closer, ok := m.options.Peer.Dialer.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	return nil
+}
+
+// Shutdown stops accepting new downloads and starting the queued ones and waits
+// for the active downloads to finish until ctx is done. Then it closes the Manager
+// and returns the downloads that were not finished, with the most important ones
+// first, so that they can be resumed later.
+func (m *Manager) Shutdown(ctx context.Context) []PendingDownload {
+	m.drainOnce.Do(func() {
+		close(m.draining)
+	})
+
+	select {
+	case <-m.drained:
+	case <-ctx.Done():
+		log.V(1).Infof("WINSTON: Shutdown grace period is over, aborting the active downloads\n")
+	case <-m.closed:
+	}
+
+	m.Close()
+	return m.pending
+}
+
+// Same as makePeerBuffer, but for results
+func makeResultBuffer(in <-chan Result) <-chan Result {
+	out := make(chan Result)
+
+	go func() {
+		defer close(out)
+		var buffered []Result
+
+		for {
+			var sendChan chan Result
+			var next Result
+			if len(buffered) > 0 {
+				sendChan = out
+				next = buffered[0]
+			} else if in == nil {
+				return
+			}
+
+			select {
+			case result, ok := <-in:
+				if !ok {
+					in = nil // Deliver the rest and quit
+					continue
+				}
+				buffered = append(buffered, result)
+			case sendChan <- next:
+				buffered = buffered[1:]
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,237 @@
+package metadata
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/na--/winston/torrent/peer"
+)
+
+// Returns a manager without peers, so the downloads only finish when they are
+// aborted. It's closed at the end of the test.
+func newTestManager(t *testing.T) *Manager {
+	options := DefaultOptions()
+	options.OutputFolder = t.TempDir()
+	options.DownloadTimeout = time.Minute
+	options.Peer.Encryption = peer.EncryptionDisabled
+	options.PeerSource = staticPeerSource{}
+
+	m, err := NewManager(options)
+	if err != nil {
+		t.Fatalf("Could not create the manager: %s", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// Adds a download that is aborted when the returned function is called
+func addAbortable(t *testing.T, m *Manager, magnet *Magnet) (*Download, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	download, err := m.AddMagnet(ctx, magnet, 0)
+	if err != nil {
+		t.Fatalf("Could not add %s: %s", magnet, err)
+	}
+	return download, cancel
+}
+
+func waitDone(t *testing.T, download *Download) {
+	select {
+	case <-download.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Download of %s did not finish", download.Magnet())
+	}
+}
+
+func TestNewManagerFailsFastWithoutListener(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer busy.Close()
+
+	// The DHT would not bootstrap in time, the listener error comes first
+	options := DefaultOptions()
+	options.ListenAddress = busy.Addr().String()
+	options.DHTBootstrapTimeout = time.Minute
+	start := time.Now()
+	m, err := NewManager(options)
+	if err == nil {
+		m.Close()
+		t.Fatalf("Expected an error for the address %s that is in use", options.ListenAddress)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("NewManager failed after %s", elapsed)
+	}
+}
+
+func TestNewManagerDefaults(t *testing.T) {
+	m, err := NewManager(&Options{OutputFolder: t.TempDir(), PeerSource: staticPeerSource{}})
+	if err != nil {
+		t.Fatalf("Could not create the manager: %s", err)
+	}
+	defer m.Close()
+
+	if m.options.MaxPeersPerDownload != defaultMaxPeersPerDownload || m.options.DownloadTimeout != defaultDownloadTimeout || m.options.MaxAttempts != 1 {
+		t.Errorf("Unexpected download defaults %+v", m.options)
+	}
+	if m.options.MinRetryDelay != defaultMinRetryDelay || m.options.MaxRetryDelay != defaultMaxRetryDelay {
+		t.Errorf("Expected the retry delays %s and %s, got %s and %s", defaultMinRetryDelay, defaultMaxRetryDelay, m.options.MinRetryDelay, m.options.MaxRetryDelay)
+	}
+}
+
+func TestManagerAddDuplicate(t *testing.T) {
+	m := newTestManager(t)
+	magnet := testMagnet(1)
+	download, cancel := addAbortable(t, m, magnet)
+
+	// The same torrent in another form gets the same handle
+	again, err := m.Add(context.Background(), hex.EncodeToString([]byte(magnet.InfoHash)))
+	if err != nil {
+		t.Fatalf("Could not add the infohash: %s", err)
+	}
+	if again != download {
+		t.Errorf("Expected the existing download, got a new one")
+	}
+
+	// Once it's finished, it can be downloaded again
+	cancel()
+	waitDone(t, download)
+	if result := download.Result(); !errors.Is(result.Err, context.Canceled) {
+		t.Errorf("Expected the download to be aborted, got %v", result.Err)
+	}
+	again, _ = addAbortable(t, m, magnet)
+	if again == download {
+		t.Errorf("Expected a new download, got the finished one")
+	}
+}
+
+func TestManagerWait(t *testing.T) {
+	m := newTestManager(t)
+
+	// Nothing to wait for
+	m.Wait()
+
+	first, cancelFirst := addAbortable(t, m, testMagnet(1))
+	second, cancelSecond := addAbortable(t, m, testMagnet(2))
+	waited := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(waited)
+	}()
+	expectWaiting := func(when string) {
+		select {
+		case <-waited:
+			t.Fatalf("Wait returned %s", when)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	cancelFirst()
+	waitDone(t, first)
+	expectWaiting("while a download was active")
+
+	// Downloads that are added while waiting are waited for as well
+	third, cancelThird := addAbortable(t, m, testMagnet(3))
+	cancelSecond()
+	waitDone(t, second)
+	expectWaiting("before the download that was added later")
+
+	cancelThird()
+	waitDone(t, third)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait did not return after all downloads finished")
+	}
+}
+
+func TestManagerResults(t *testing.T) {
+	m := newTestManager(t)
+	results := m.Results()
+
+	var downloads []*Download
+	var cancels []context.CancelFunc
+	for i := byte(1); i <= 4; i++ {
+		download, cancel := addAbortable(t, m, testMagnet(i))
+		downloads = append(downloads, download)
+		cancels = append(cancels, cancel)
+	}
+
+	// The results come in the order the downloads finished, not the order they were added
+	order := []int{2, 0, 1}
+	for _, i := range order {
+		cancels[i]()
+		waitDone(t, downloads[i])
+	}
+	for _, i := range order {
+		select {
+		case result := <-results:
+			if result.InfoHash != downloads[i].Magnet().InfoHash || !errors.Is(result.Err, context.Canceled) {
+				t.Errorf("Expected the aborted download %s, got %x (%v)", downloads[i].Magnet(), result.InfoHash, result.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out while waiting for the result of %s", downloads[i].Magnet())
+		}
+	}
+
+	// The unfinished download is aborted by Close, then the channel is closed
+	m.Close()
+	if result := downloads[3].Result(); result.Err != ErrManagerClosed {
+		t.Errorf("Expected ErrManagerClosed for the unfinished download, got %v", result.Err)
+	}
+	var closed []Result
+	for result := range results {
+		closed = append(closed, result)
+	}
+	if len(closed) != 1 || closed[0].InfoHash != downloads[3].Magnet().InfoHash || closed[0].Err != ErrManagerClosed {
+		t.Errorf("Expected ErrManagerClosed for %s only, got %+v", downloads[3].Magnet(), closed)
+	}
+}
+
+func TestManagerAddAfterClose(t *testing.T) {
+	m := newTestManager(t)
+	m.Close()
+	if _, err := m.AddMagnet(context.Background(), testMagnet(1), 0); err != ErrManagerClosed {
+		t.Errorf("Expected ErrManagerClosed after Close, got %v", err)
+	}
+
+	m = newTestManager(t)
+	m.Shutdown(context.Background())
+	if _, err := m.Add(context.Background(), hex.EncodeToString([]byte(testMagnet(1).InfoHash))); err != ErrManagerClosed {
+		t.Errorf("Expected ErrManagerClosed after Shutdown, got %v", err)
+	}
+}
+
+func TestManagerShutdownPending(t *testing.T) {
+	m := newTestManager(t)
+	priorities := []int{0, 5, 0, 5, -1}
+	for i, priority := range priorities {
+		if _, err := m.AddMagnet(context.Background(), testMagnet(byte(i+1)), priority); err != nil {
+			t.Fatalf("Could not add %d: %s", i, err)
+		}
+	}
+
+	// Nothing can finish, so everything is pending, the most important first
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pending := m.Shutdown(ctx)
+	var got []string
+	for _, p := range pending {
+		got = append(got, p.Magnet.DisplayName)
+	}
+	want := []string{"torrent 2", "torrent 4", "torrent 1", "torrent 3", "torrent 5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the pending downloads %q, got %q", want, got)
+	}
+	for i := 1; i < len(pending); i++ {
+		if pending[i-1].Priority == pending[i].Priority && !pending[i-1].Added.Before(pending[i].Added) {
+			t.Errorf("%s was added after %s", pending[i-1].Magnet, pending[i].Magnet)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package metadata
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/na--/winston/torrent/peer"
+)
+
+const (
+	defaultOutputFolder        = "./tmp/"
+	defaultDownloadTimeout     = 10 * time.Minute
+	defaultMaxPeersPerDownload = 8
+	defaultDHTMinNodes         = 30
+	defaultBootstrapTimeout    = 15 * time.Second
+	defaultMaxAttempts         = 5
+	defaultMinRetryDelay       = 30 * time.Minute
+	defaultMaxRetryDelay       = 24 * time.Hour
+)
+
+// Options configure the Manager
+type Options struct {
+	Peer          peer.Options // Used for all peer connections, the Dialer is closed with the Manager
+	PeerSource    PeerSource   // Used for finding peers, a new DHT node is started if nil
+	ListenAddress string       // Address for accepting incoming peer connections, disabled if empty
+	Trackers      []string     // Used for all torrents, in addition to the ones from the magnet links
+	OutputFolder  string       // Where the downloaded torrent files are saved
+
+	DownloadTimeout        time.Duration // For the metadata of a single torrent
+	MaxConcurrentDownloads int           // The other torrents wait in a queue, 0 means no limit
+	MaxPeersPerDownload    int           // Simultaneous peer connections for a single torrent
+	MaxPeerConnections     int           // Simultaneous peer connections for all torrents, 0 means no limit
+
+	DHTMinNodes         int           // Nodes needed for the DHT to be considered bootstrapped, if we start it
+	DHTBootstrapTimeout time.Duration // Maximum time to wait for our DHT to bootstrap
+
+	// Used by RunQueue for the failed downloads, the delay is doubled after every attempt
+	MaxAttempts   int
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// DefaultOptions returns the options that NewManager uses when it gets nil
+func DefaultOptions() *Options {
+	return &Options{
+		Peer:                peer.DefaultOptions,
+		OutputFolder:        defaultOutputFolder,
+		DownloadTimeout:     defaultDownloadTimeout,
+		MaxPeersPerDownload: defaultMaxPeersPerDownload,
+		DHTMinNodes:         defaultDHTMinNodes,
+		DHTBootstrapTimeout: defaultBootstrapTimeout,
+		MaxAttempts:         defaultMaxAttempts,
+		MinRetryDelay:       defaultMinRetryDelay,
+		MaxRetryDelay:       defaultMaxRetryDelay,
+	}
+}
+
+// OptionsFromFlags returns the options specified with the command-line flags and
+// the config file, if there is one. It should be called after flag.Parse().
+func OptionsFromFlags() (options *Options, err error) {
+	if *configFile != "" {
+		if err = LoadConfigFile(*configFile); err != nil {
+			return
+		}
+	}
+
+	options = DefaultOptions()
+	options.Peer.Encryption, err = peer.ParseEncryptionPolicy(*encryptionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Peer.Dialer, err = makeDialer(*transports, *parallelTransports, peer.DialerConfig{
+		LocalAddress:   *bindAddress,
+		SOCKS5Proxy:    *socks5Proxy,
+		SOCKS5Username: *socks5Username,
+		SOCKS5Password: *socks5Password,
+	})
+	if err != nil {
+		// Silently falling back to direct connections could bypass the proxy or bind address
+		return nil, fmt.Errorf("Invalid peer connection settings: %s", err)
+	}
+
+	options.Peer.DialTimeout = *dialTimeout
+	options.Peer.HandshakeTimeout = *handshakeTimeout
+	options.Peer.ReadTimeout = *readTimeout
+	options.Peer.WriteTimeout = *writeTimeout
+	options.Peer.MaxMessageSize = *maxMessageSize
+	options.Peer.MaxMetadataSize = *maxMetadataSize
+
+	options.ListenAddress = *listenAddress
+	options.Trackers = parseTrackers(*trackers)
+	options.OutputFolder = *outputFolder
+	options.DownloadTimeout = *downloadTimeout
+	options.MaxConcurrentDownloads = *maxDownloads
+	options.MaxPeersPerDownload = *maxPeersPerDownload
+	options.MaxPeerConnections = *maxPeerConnections
+	options.DHTMinNodes = *dhtMinNodes
+	options.DHTBootstrapTimeout = *dhtBootstrapTimeout
+	options.MaxAttempts = *maxAttempts
+	options.MinRetryDelay = *minRetryDelay
+	options.MaxRetryDelay = *maxRetryDelay
+	return
+}
+
+// LoadConfigFile sets the command-line flags from a file with one "name = value"
+// (or "name value") per line, boolean flags can be alone on their line to enable
+// them. Empty lines and lines starting with # are ignored.
+// Flags that were explicitly set on the command line are not changed.
+func LoadConfigFile(path string) error {
+	return loadConfigFile(flag.CommandLine, path)
+}
+
+// Same as LoadConfigFile, but for the flags in fs
+func loadConfigFile(fs *flag.FlagSet, path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open config file: %s", err)
+	}
+	defer f.Close()
+
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, hasValue := line, "", false
+		if i := strings.IndexAny(line, "= \t"); i >= 0 {
+			name, value, hasValue = line[:i], strings.TrimSpace(line[i+1:]), true
+			value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		}
+		name = strings.TrimLeft(name, "-")
+
+		option := fs.Lookup(name)
+		if name == "config" || option == nil {
+			return fmt.Errorf("Unknown option '%s' in %s:%d", name, path, lineNumber)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		// A bare boolean option is enabled, like on the command line
+		if boolFlag, ok := option.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() && !hasValue {
+			value = "true"
+		}
+		if err = fs.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid value for '%s' in %s:%d: %s", name, path, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,90 @@
+package metadata
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		commandLine []string
+		want        map[string]string
+		wantErr     string
+	}{
+		{
+			name:   "equals signs and spaces",
+			config: "# A comment\n\nname = winston\n  count=3\ntimeout\t 1m\n--verbose = false\n",
+			want:   map[string]string{"name": "winston", "count": "3", "timeout": "1m0s", "verbose": "false"},
+		},
+		{
+			name:   "bare boolean",
+			config: "verbose\n",
+			want:   map[string]string{"verbose": "true"},
+		},
+		{
+			name:   "boolean with a value",
+			config: "verbose true\n",
+			want:   map[string]string{"verbose": "true"},
+		},
+		{
+			name:        "command line takes precedence",
+			config:      "name = config\ncount = 3\n",
+			commandLine: []string{"-name", "command line"},
+			want:        map[string]string{"name": "command line", "count": "3"},
+		},
+		{
+			name:   "empty value",
+			config: "name =\n",
+			want:   map[string]string{"name": ""},
+		},
+		{name: "unknown option", config: "name = a\nunknown = 1\n", wantErr: "Unknown option 'unknown'"},
+		{name: "config option", config: "config = other.conf\n", wantErr: "Unknown option 'config'"},
+		{name: "bare non-boolean", config: "count\n", wantErr: "Invalid value for 'count'"},
+		{name: "invalid value", config: "\ntimeout = soon\n", wantErr: ":2: "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("name", "default", "")
+			fs.Int("count", 1, "")
+			fs.Duration("timeout", time.Second, "")
+			fs.Bool("verbose", false, "")
+			fs.String("config", "", "")
+			if err := fs.Parse(test.commandLine); err != nil {
+				t.Fatalf("Could not parse the command line: %s", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "winston.conf")
+			if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatalf("Could not write the config file: %s", err)
+			}
+
+			err := loadConfigFile(fs, path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("Expected an error with %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			for name, want := range test.want {
+				if value := fs.Lookup(name).Value.String(); value != want {
+					t.Errorf("Expected %s = %q, got %q", name, want, value)
+				}
+			}
+		})
+	}
+
+	if err := loadConfigFile(flag.NewFlagSet("test", flag.ContinueOnError), filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Errorf("Expected an error for a missing config file")
+	}
+}
@@ -0,0 +1,260 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/nictuku/dht"
+)
+
+const (
+	// How many batches of peers can wait for every torrent before new ones are dropped
+	peerSourceBuffer = 16
+	// How often the routing table is checked while the DHT node is bootstrapping
+	bootstrapPollInterval = 500 * time.Millisecond
+	// How long a DHT node is counted after its last reply. The DHT library pings the
+	// nodes in its routing table every 15 minutes and removes them after two missed
+	// cleanups with the default config.
+	dhtNodeExpiry = 30 * time.Minute
+)
+
+// PeerSource finds peers for torrents, e.g. a DHT node
+type PeerSource interface {
+	// FindPeers starts looking for peers for the torrent with the specified raw
+	// infohash. The found peers, in the host:port format, are sent to the returned
+	// channel, which is closed once ctx is cancelled.
+	FindPeers(ctx context.Context, infoHash string) <-chan []string
+}
+
+// PeerRefresher is implemented by the peer sources that can be asked to repeat
+// the lookup for a torrent, when the previously found peers were not enough
+type PeerRefresher interface {
+	RefreshPeers(infoHash string)
+}
+
+// Counts the nodes that reply to the queries of a single DHT node. The DHT library
+// only exposes the size of its routing table as a global expvar for all nodes in
+// the process, so the replies are taken from the debug messages of the node.
+type dhtNodeCounter struct {
+	dht.DebugLogger // The previous logger of the node, it still gets all messages
+
+	mu         sync.Mutex
+	responding string               // The ID of the node whose response is being processed
+	lastReply  map[string]time.Time // By node ID
+	lastPrune  time.Time
+}
+
+func (c *dhtNodeCounter) Debugf(format string, args ...interface{}) {
+	// The DHT node logs the first message for every response and the second one
+	// only for the replies to its own queries, right after it
+	switch format {
+	case "DHT processing packet from %v":
+		c.mu.Lock()
+		c.responding = ""
+		c.mu.Unlock()
+	case "DHT processing response from %x":
+		c.mu.Lock()
+		c.responding, _ = args[0].(string)
+		c.mu.Unlock()
+	case "DHT: Received reply to %v":
+		c.mu.Lock()
+		if c.responding != "" {
+			c.lastReply[c.responding] = time.Now()
+		}
+		if time.Since(c.lastPrune) > dhtNodeExpiry {
+			c.prune()
+		}
+		c.mu.Unlock()
+	}
+	c.DebugLogger.Debugf(format, args...)
+}
+
+// Forgets the nodes that haven't replied for a while, the mutex should be held
+func (c *dhtNodeCounter) prune() {
+	c.lastPrune = time.Now()
+	for id, lastReply := range c.lastReply {
+		if time.Since(lastReply) > dhtNodeExpiry {
+			delete(c.lastReply, id)
+		}
+	}
+}
+
+func (c *dhtNodeCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune()
+	return len(c.lastReply)
+}
+
+// DHTPeerSource is a PeerSource that finds peers with a DHT node. It can be shared
+// by multiple managers, since it dispatches the DHT results to all of them.
+type DHTPeerSource struct {
+	node     *dht.DHT
+	nodes    *dhtNodeCounter
+	minNodes int
+	ready    chan struct{}
+	done     chan struct{} // Closed by Stop
+	stopOnce sync.Once
+
+	mu          sync.Mutex
+	subscribers map[dht.InfoHash]map[chan []string]bool
+}
+
+// NewDHTPeerSource creates a peer source for the DHT node, which should not be
+// started yet, since the source counts its nodes through its DebugLogger.
+// Nobody else should read from the node's PeersRequestResults channel. The source
+// is considered ready once at least minNodes nodes have replied to the node. Peer
+// lookups made before that are repeated when it becomes ready.
+func NewDHTPeerSource(node *dht.DHT, minNodes int) *DHTPeerSource {
+	nodes := &dhtNodeCounter{DebugLogger: node.DebugLogger, lastReply: make(map[string]time.Time)}
+	node.DebugLogger = nodes
+
+	s := &DHTPeerSource{
+		node:        node,
+		nodes:       nodes,
+		minNodes:    minNodes,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribers: make(map[dht.InfoHash]map[chan []string]bool),
+	}
+	go s.dispatch()
+	go s.waitForBootstrap()
+	return s
+}
+
+// Stop stops dispatching the results of the DHT node, which should be done before
+// the node itself is stopped. The node is not stopped by it.
+func (s *DHTPeerSource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// NodeCount returns the number of DHT nodes that have recently replied to the
+// node, which is roughly the number of good nodes in its routing table
+func (s *DHTPeerSource) NodeCount() int {
+	return s.nodes.count()
+}
+
+// Ready returns a channel that is closed once the DHT node has bootstrapped
+func (s *DHTPeerSource) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// IsReady reports whether the DHT node has bootstrapped
+func (s *DHTPeerSource) IsReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady blocks until the DHT node has bootstrapped or ctx is done and
+// reports whether the node is ready
+func (s *DHTPeerSource) WaitReady(ctx context.Context) bool {
+	select {
+	case <-s.ready:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Polls the routing table until it's healthy and then repeats all the pending peer
+// lookups, since the ones made with an empty routing table probably found nothing
+func (s *DHTPeerSource) waitForBootstrap() {
+	start := time.Now()
+	for s.NodeCount() < s.minNodes {
+		select {
+		case <-time.After(bootstrapPollInterval):
+		case <-s.done:
+			return
+		}
+	}
+	log.V(1).Infof("WINSTON: DHT bootstrapped with %d nodes in %s\n", s.NodeCount(), time.Since(start))
+
+	s.mu.Lock()
+	close(s.ready)
+	var pending []dht.InfoHash
+	for ih := range s.subscribers {
+		pending = append(pending, ih)
+	}
+	s.mu.Unlock()
+
+	// Not done with the mutex held, the DHT node may be waiting for dispatch() to take it
+	for _, ih := range pending {
+		s.node.PeersRequest(string(ih), false)
+	}
+}
+
+// FindPeers implements PeerSource
+func (s *DHTPeerSource) FindPeers(ctx context.Context, infoHash string) <-chan []string {
+	peers := make(chan []string, peerSourceBuffer)
+	ih := dht.InfoHash(infoHash)
+
+	s.mu.Lock()
+	if s.subscribers[ih] == nil {
+		s.subscribers[ih] = make(map[chan []string]bool)
+	}
+	s.subscribers[ih][peers] = true
+	s.mu.Unlock()
+
+	// Ask that nice DHT fellow to find those peers :)
+	s.node.PeersRequest(infoHash, false)
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers[ih], peers)
+		if len(s.subscribers[ih]) == 0 {
+			delete(s.subscribers, ih)
+		}
+		close(peers)
+	}()
+
+	return peers
+}
+
+// RefreshPeers implements PeerRefresher
+func (s *DHTPeerSource) RefreshPeers(infoHash string) {
+	s.node.PeersRequest(infoHash, false)
+}
+
+// Passes the results of the DHT node to everyone who's interested in them
+func (s *DHTPeerSource) dispatch() {
+	for {
+		var newPeers map[dht.InfoHash][]string
+		select {
+		case newPeers = <-s.node.PeersRequestResults:
+		case <-s.done:
+			log.V(2).Infof("WINSTON: Stopped dispatching the DHT results\n")
+			return
+		}
+
+		for ih, peers := range newPeers {
+			decodedPeers := make([]string, len(peers))
+			for i, p := range peers {
+				decodedPeers[i] = dht.DecodePeerAddress(p)
+			}
+
+			s.mu.Lock()
+			if len(s.subscribers[ih]) == 0 {
+				log.V(3).Infof("WINSTON: Received %d peers for non-current file %x (probably completed or timed out)\n", len(peers), ih)
+			}
+			for subscriber := range s.subscribers[ih] {
+				select {
+				case subscriber <- decodedPeers:
+				default:
+					log.V(3).Infof("WINSTON: Dropping %d peers for file %x, nobody is reading them\n", len(peers), ih)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
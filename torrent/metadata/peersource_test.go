@@ -0,0 +1,134 @@
+package metadata
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nictuku/dht"
+)
+
+// Records the debug messages that are passed on
+type countingLogger struct {
+	dht.DebugLogger
+	debug int
+}
+
+func (l *countingLogger) Debugf(format string, args ...interface{}) {
+	l.debug++
+}
+
+func TestDHTNodeCounter(t *testing.T) {
+	previous := &countingLogger{}
+	c := &dhtNodeCounter{DebugLogger: previous, lastReply: make(map[string]time.Time)}
+	response := func(id string, reply bool) {
+		c.Debugf("DHT processing packet from %v", "10.0.0.1:6881")
+		c.Debugf("DHT processing response from %x", id)
+		if reply {
+			c.Debugf("DHT: Received reply to %v", "ping")
+		} else {
+			c.Debugf("DHT: Received reply from a host we don't know: %v", "10.0.0.1:6881")
+		}
+	}
+
+	response("node 1", true)
+	response("node 2", true)
+	response("node 1", true)
+	response("unknown", false)
+	// Only the replies in the same packet are counted
+	c.Debugf("DHT processing packet from %v", "10.0.0.2:6881")
+	c.Debugf("DHT: Received reply to %v", "ping")
+	if count := c.count(); count != 2 {
+		t.Errorf("Expected 2 nodes, got %d", count)
+	}
+	if previous.debug != 14 {
+		t.Errorf("Expected all 14 messages to be passed on, got %d", previous.debug)
+	}
+
+	// The nodes that haven't replied for a while are not counted
+	c.lastReply["node 2"] = time.Now().Add(-dhtNodeExpiry - time.Second)
+	if count := c.count(); count != 1 {
+		t.Errorf("Expected 1 node after node 2 expired, got %d", count)
+	}
+}
+
+// Returns a DHT node on localhost that doesn't contact the real DHT routers
+func newTestDHTNode(t *testing.T) *dht.DHT {
+	config := dht.NewConfig()
+	config.Address = "127.0.0.1"
+	config.Port = 0
+	config.DHTRouters = ""
+	config.SaveRoutingTable = false
+	node, err := dht.New(config)
+	if err != nil {
+		t.Fatalf("Could not create a DHT node: %s", err)
+	}
+	return node
+}
+
+func TestDHTPeerSourceNodeCount(t *testing.T) {
+	first, second, third, isolated := newTestDHTNode(t), newTestDHTNode(t), newTestDHTNode(t), newTestDHTNode(t)
+	firstSource := NewDHTPeerSource(first, 2)
+	isolatedSource := NewDHTPeerSource(isolated, 1)
+	for _, node := range []*dht.DHT{first, second, third, isolated} {
+		if err := node.Start(); err != nil {
+			t.Fatalf("Could not start a DHT node: %s", err)
+		}
+		defer node.Stop()
+	}
+
+	// The isolated node has no nodes, even though the DHT library's global
+	// counters include the ones of the other nodes
+	for _, node := range []*dht.DHT{second, third} {
+		first.AddNode(net.JoinHostPort("127.0.0.1", strconv.Itoa(node.Port())))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for firstSource.NodeCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if count := firstSource.NodeCount(); count != 2 {
+		t.Errorf("Expected 2 nodes for the first source, got %d", count)
+	}
+	if !firstSource.IsReady() {
+		// It's polled, so it can take a while
+		select {
+		case <-firstSource.Ready():
+		case <-time.After(2 * bootstrapPollInterval):
+			t.Errorf("The first source is not ready with %d nodes", firstSource.NodeCount())
+		}
+	}
+	if count := isolatedSource.NodeCount(); count != 0 {
+		t.Errorf("Expected no nodes for the isolated source, got %d", count)
+	}
+}
+
+func TestDHTPeerSourceStop(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	node := newTestDHTNode(t)
+	source := NewDHTPeerSource(node, 1)
+	if err := node.Start(); err != nil {
+		t.Fatalf("Could not start the DHT node: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := source.FindPeers(ctx, string(make([]byte, sha1Size)))
+
+	// The node never returns anything, but the source stops waiting for it
+	source.Stop()
+	source.Stop()
+	node.Stop()
+	cancel()
+	for range peers {
+	}
+	for start := time.Now(); runtime.NumGoroutine() > goroutines; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d goroutines are still running, expected %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source.IsReady() {
+		t.Errorf("The source is ready without any nodes")
+	}
+}
@@ -0,0 +1,422 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// JobState is the state of a torrent in the Queue
+type JobState string
+
+// The states of the jobs in the Queue
+const (
+	JobPending    JobState = "pending"     // Waiting to be downloaded, possibly not before NextAttempt
+	JobInProgress JobState = "in_progress" // Being downloaded
+	JobDone       JobState = "done"        // The metadata was downloaded
+	JobFailed     JobState = "failed"      // All attempts failed, Error is the last reason
+)
+
+const (
+	// When the journal has this many more lines than there are jobs, it's rewritten
+	queueCompactionSlack = 1000
+	// How many jobs RunQueue takes at the same time, if MaxConcurrentDownloads is not limited
+	defaultQueueConcurrency = 64
+)
+
+// Job is a torrent in the Queue
+type Job struct {
+	InfoHash    string    `json:"infohash"` // Hex-encoded
+	Magnet      string    `json:"magnet"`   // The magnet link, with all the known information about the torrent
+	Priority    int       `json:"priority,omitempty"`
+	State       JobState  `json:"state"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"` // Why the last attempt failed
+	NextAttempt time.Time `json:"next_attempt"`    // Pending jobs are not started before that
+	Added       time.Time `json:"added"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Queue is a durable list of torrents to download, saved in a file as a journal of
+// JSON Lines, one line for every change of a job. Jobs that were in progress when
+// the queue was closed are pending again when it's opened. All of its methods are
+// safe for concurrent use.
+type Queue struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	lines   int // In the journal
+	jobs    map[string]*Job
+	changed chan struct{} // Closed and replaced every time a job changes
+}
+
+// OpenQueue opens the queue in the file, which is created if it doesn't exist
+func OpenQueue(path string) (q *Queue, err error) {
+	q = &Queue{
+		path:    path,
+		jobs:    make(map[string]*Job),
+		changed: make(chan struct{}),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not open the queue: %s", err)
+	}
+	if err == nil {
+		// The last line for every job is its current state
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		badLine, lineNumber := 0, 0
+		var badErr error
+		for scanner.Scan() {
+			lineNumber++
+			if badLine != 0 {
+				break // Only the last line can be broken
+			}
+			job := &Job{}
+			if badErr = json.Unmarshal(scanner.Bytes(), job); badErr != nil {
+				badLine = lineNumber
+				continue
+			}
+			q.jobs[job.InfoHash] = job
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the queue: %s", err)
+		}
+		if badLine != 0 && badLine != lineNumber {
+			return nil, fmt.Errorf("Invalid line %d in the queue %s: %s", badLine, path, badErr)
+		}
+		if badLine != 0 {
+			// Probably written by a process that crashed, the rest is fine
+			log.Errorf("WINSTON: Skipping the invalid last line %d of the queue %s: %s\n", badLine, path, badErr)
+		}
+	}
+
+	for _, job := range q.jobs {
+		if job.State == JobInProgress {
+			job.State = JobPending
+		}
+	}
+
+	if err = q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Rewrites the journal with only the current state of the jobs
+func (q *Queue) compact() (err error) {
+	tempFile := q.path + ".tmp"
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return fmt.Errorf("Could not create the queue file: %s", err)
+	}
+
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	for _, job := range q.sortedJobs() {
+		if err = encoder.Encode(job); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile, q.path)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("Could not save the queue: %s", err)
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open the queue: %s", err)
+	}
+	q.lines = len(q.jobs)
+	return nil
+}
+
+// Appends the new state of the job to the journal and notifies everyone who's waiting for changes
+func (q *Queue) save(job *Job) error {
+	job.Updated = time.Now()
+	q.jobs[job.InfoHash] = job
+
+	close(q.changed)
+	q.changed = make(chan struct{})
+
+	if q.file == nil {
+		return fmt.Errorf("The queue is closed")
+	}
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(job); err != nil {
+		return err
+	}
+	_, err := q.file.Write(line.Bytes())
+	if err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not save job %s to the queue: %s", job.InfoHash, err)
+	}
+
+	q.lines++
+	if q.lines > 2*len(q.jobs)+queueCompactionSlack {
+		return q.compact()
+	}
+	return nil
+}
+
+// The jobs with the highest priority first, then in the order they were added
+func (q *Queue) sortedJobs() (jobs []*Job) {
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		if !jobs[i].Added.Equal(jobs[j].Added) {
+			return jobs[i].Added.Before(jobs[j].Added)
+		}
+		return jobs[i].InfoHash < jobs[j].InfoHash
+	})
+	return
+}
+
+// Push adds the torrent to the queue as a pending job. Torrents that are already in
+// the queue are not changed, whatever their state, and false is returned for them.
+func (q *Queue) Push(magnet *Magnet, priority int) (added bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	infoHash := hex.EncodeToString([]byte(magnet.InfoHash))
+	if _, ok := q.jobs[infoHash]; ok {
+		return false, nil
+	}
+	job := &Job{
+		InfoHash: infoHash,
+		Magnet:   magnet.URI(),
+		Priority: priority,
+		State:    JobPending,
+		Added:    time.Now(),
+	}
+	return true, q.save(job)
+}
+
+// Take returns the pending job with the highest priority that can be started now,
+// after marking it as in progress and counting the attempt. ok is false if there
+// is no such job.
+func (q *Queue) Take() (job Job, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, candidate := range q.sortedJobs() {
+		if candidate.State == JobPending && !candidate.NextAttempt.After(now) {
+			taken := *candidate
+			taken.State = JobInProgress
+			taken.Attempts++
+			err = q.save(&taken)
+			return taken, true, err
+		}
+	}
+	return
+}
+
+// Update saves the new state of the job
+func (q *Queue) Update(job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.save(&job)
+}
+
+// Get returns the job for the hex-encoded infohash
+func (q *Queue) Get(infoHash string) (job Job, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if found, ok := q.jobs[infoHash]; ok {
+		return *found, true
+	}
+	return
+}
+
+// Jobs returns all the jobs, the ones that will be started first are first
+func (q *Queue) Jobs() (jobs []Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.sortedJobs() {
+		jobs = append(jobs, *job)
+	}
+	return
+}
+
+// Unfinished returns how many jobs are pending or in progress and when the earliest
+// pending one can be started. pending is false if no jobs are pending.
+func (q *Queue) Unfinished() (count int, nextAttempt time.Time, pending bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.State != JobPending && job.State != JobInProgress {
+			continue
+		}
+		count++
+		if job.State == JobPending && (!pending || job.NextAttempt.Before(nextAttempt)) {
+			nextAttempt = job.NextAttempt
+			pending = true
+		}
+	}
+	return
+}
+
+// Changed returns a channel that is closed the next time a job changes
+func (q *Queue) Changed() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.changed
+}
+
+// Close closes the queue file
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// RunQueue downloads the jobs from the queue until ctx is done or the Manager is
+// closed. Failed downloads are retried after MinRetryDelay, which is doubled after
+// every attempt up to MaxRetryDelay, until MaxAttempts is reached. The downloads
+// are not aborted when ctx is done, that's what Shutdown and Close are for. The
+// jobs of the downloads that they abort are pending again, without the attempt.
+func (m *Manager) RunQueue(ctx context.Context, q *Queue) error {
+	concurrency := m.options.MaxConcurrentDownloads
+	if concurrency <= 0 {
+		concurrency = defaultQueueConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for ctx.Err() == nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		changed := q.Changed()
+		job, ok, err := q.Take()
+		if err != nil {
+			<-slots
+			return err
+		}
+		if !ok {
+			<-slots
+
+			// Wait until a new job is pushed or the next retry is due
+			var retry <-chan time.Time
+			var timer *time.Timer
+			if _, nextAttempt, pending := q.Unfinished(); pending {
+				log.V(2).Infof("WINSTON: No queued torrents can be started now, the next retry is at %s\n", nextAttempt.Format(time.RFC3339))
+				timer = time.NewTimer(time.Until(nextAttempt))
+				retry = timer.C
+			}
+			select {
+			case <-changed:
+			case <-retry:
+			case <-ctx.Done():
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+
+		magnet, err := ParseMagnet(job.Magnet)
+		if err != nil {
+			job.State, job.Error = JobFailed, err.Error()
+			<-slots
+			if err = q.Update(job); err != nil {
+				return err
+			}
+			continue
+		}
+
+		download, err := m.AddMagnet(context.Background(), magnet, job.Priority)
+		if err != nil {
+			// The manager is closed, the job can be resumed later
+			job.State, job.Attempts = JobPending, job.Attempts-1
+			<-slots
+			q.Update(job)
+			return nil
+		}
+
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := q.Update(m.finishJob(job, download.Result())); err != nil {
+				log.Errorf("WINSTON: Could not update the queue: %s\n", err)
+			}
+		}(job)
+	}
+	return nil
+}
+
+// Returns the new state of the job after the download
+func (m *Manager) finishJob(job Job, result Result) Job {
+	switch {
+	case result.Err == nil:
+		job.State, job.Error = JobDone, ""
+
+	case result.Err == ErrManagerClosed || result.Err == context.Canceled:
+		job.State, job.Attempts = JobPending, job.Attempts-1
+
+	case job.Attempts >= m.options.MaxAttempts:
+		log.V(1).Infof("WINSTON: Giving up on %s after %d attempts: %s\n", job.InfoHash, job.Attempts, result.Err)
+		job.State, job.Error = JobFailed, result.Err.Error()
+
+	default:
+		delay := m.options.MinRetryDelay
+		for i := 1; i < job.Attempts && delay < m.options.MaxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > m.options.MaxRetryDelay {
+			delay = m.options.MaxRetryDelay
+		}
+		log.V(1).Infof("WINSTON: Attempt %d for %s failed (%s), retrying in %s\n", job.Attempts, job.InfoHash, result.Err, delay)
+		job.State, job.Error, job.NextAttempt = JobPending, result.Err.Error(), time.Now().Add(delay)
+	}
+	return job
+}
@@ -0,0 +1,183 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMagnet(b byte) *Magnet {
+	return &Magnet{InfoHash: strings.Repeat(string([]byte{b}), sha1Size), DisplayName: "torrent " + string([]byte{'0' + b})}
+}
+
+func TestQueueReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatalf("Could not open the queue: %s", err)
+	}
+	for i, priority := range []int{0, 5, 0} {
+		if added, err := q.Push(testMagnet(byte(i+1)), priority); !added || err != nil {
+			t.Fatalf("Could not push job %d: %v, %v", i, added, err)
+		}
+	}
+	if added, err := q.Push(testMagnet(1), 10); added || err != nil {
+		t.Errorf("A torrent that is already queued was added again: %v, %v", added, err)
+	}
+
+	// The job with the highest priority is taken first
+	taken, ok, err := q.Take()
+	if !ok || err != nil || taken.InfoHash != q.Jobs()[0].InfoHash || taken.Priority != 5 {
+		t.Fatalf("Expected the job with priority 5, got %+v (%v, %v)", taken, ok, err)
+	}
+	done, _, _ := q.Take()
+	done.State = JobDone
+	if err = q.Update(done); err != nil {
+		t.Fatalf("Could not update the job: %s", err)
+	}
+	q.Close()
+
+	// A process that crashed in the middle of a line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"infohash":"0303030303030303030303030303030303030303","state":"do`)
+	f.Close()
+
+	q, err = OpenQueue(path)
+	if err != nil {
+		t.Fatalf("Could not reopen the queue: %s", err)
+	}
+	defer q.Close()
+
+	wantStates := map[string]JobState{
+		taken.InfoHash:                 JobPending, // It was in progress
+		done.InfoHash:                  JobDone,
+		strings.Repeat("03", sha1Size): JobPending,
+	}
+	jobs := q.Jobs()
+	if len(jobs) != len(wantStates) {
+		t.Fatalf("Expected %d jobs, got %+v", len(wantStates), jobs)
+	}
+	for _, job := range jobs {
+		if job.State != wantStates[job.InfoHash] {
+			t.Errorf("Expected job %s to be %s, got %s", job.InfoHash, wantStates[job.InfoHash], job.State)
+		}
+	}
+	if job, _ := q.Get(taken.InfoHash); job.Attempts != 1 || job.Priority != 5 {
+		t.Errorf("Expected the interrupted job to keep its attempt and priority, got %+v", job)
+	}
+	if magnet, err := ParseMagnet(jobs[0].Magnet); err != nil || magnet.DisplayName != testMagnet(2).DisplayName {
+		t.Errorf("The magnet link was not kept: %s (%v)", jobs[0].Magnet, err)
+	}
+	if count, _, pending := q.Unfinished(); count != 2 || !pending {
+		t.Errorf("Expected 2 unfinished jobs, got %d", count)
+	}
+
+	// The journal is compacted when it's opened
+	contents, _ := os.ReadFile(path)
+	if lines := bytes.Count(contents, []byte("\n")); lines != len(wantStates) {
+		t.Errorf("Expected %d lines in the compacted journal, got %d", len(wantStates), lines)
+	}
+}
+
+func TestQueueCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatalf("Could not open the queue: %s", err)
+	}
+	q.Push(testMagnet(1), 0)
+	q.Push(testMagnet(2), 0)
+	q.Close()
+
+	// Only the last line can be lost in a crash, anything else is not ours to drop
+	contents, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(contents), "\n")
+	corrupted := lines[0] + "not a job\n" + strings.Join(lines[1:], "")
+	os.WriteFile(path, []byte(corrupted), 0644)
+
+	if q, err = OpenQueue(path); err == nil {
+		q.Close()
+		t.Fatalf("Expected an error for the invalid line in the middle of the queue")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected the number of the invalid line, got %s", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != corrupted {
+		t.Errorf("The invalid queue was changed: %q", after)
+	}
+}
+
+func TestQueueCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatalf("Could not open the queue: %s", err)
+	}
+	defer q.Close()
+
+	q.Push(testMagnet(1), 0)
+	job, _, _ := q.Take()
+	for i := 0; i < queueCompactionSlack+10; i++ {
+		if err = q.Update(job); err != nil {
+			t.Fatalf("Could not update the job: %s", err)
+		}
+	}
+	contents, _ := os.ReadFile(path)
+	if lines := bytes.Count(contents, []byte("\n")); lines > queueCompactionSlack {
+		t.Errorf("The journal was not compacted, it has %d lines", lines)
+	}
+}
+
+func TestFinishJob(t *testing.T) {
+	m := &Manager{options: Options{MinRetryDelay: time.Minute, MaxRetryDelay: 10 * time.Minute, MaxAttempts: 6}}
+	failure := errors.New("no peers")
+
+	tests := []struct {
+		name         string
+		attempts     int
+		err          error
+		wantState    JobState
+		wantAttempts int
+		wantDelay    time.Duration
+	}{
+		{"success", 3, nil, JobDone, 3, 0},
+		{"first failure", 1, failure, JobPending, 1, time.Minute},
+		{"second failure", 2, failure, JobPending, 2, 2 * time.Minute},
+		{"third failure", 3, failure, JobPending, 3, 4 * time.Minute},
+		{"fourth failure", 4, failure, JobPending, 4, 8 * time.Minute},
+		{"capped delay", 5, failure, JobPending, 5, 10 * time.Minute},
+		{"timeout", 2, ErrDownloadTimeout, JobPending, 2, 2 * time.Minute},
+		{"last attempt", 6, failure, JobFailed, 6, 0},
+		{"manager closed", 3, ErrManagerClosed, JobPending, 2, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := Job{InfoHash: "01", State: JobInProgress, Attempts: test.attempts, Error: "previous error"}
+			before := time.Now()
+			job = m.finishJob(job, Result{Err: test.err})
+
+			if job.State != test.wantState || job.Attempts != test.wantAttempts {
+				t.Errorf("Expected state %s after %d attempts, got %s after %d", test.wantState, test.wantAttempts, job.State, job.Attempts)
+			}
+			if test.wantDelay > 0 {
+				if delay := job.NextAttempt.Sub(before); delay < test.wantDelay || delay > test.wantDelay+time.Second {
+					t.Errorf("Expected a retry in %s, got %s", test.wantDelay, delay)
+				}
+			} else if !job.NextAttempt.IsZero() {
+				t.Errorf("Expected no retry time, got %s", job.NextAttempt)
+			}
+
+			switch {
+			case test.err == nil && job.Error != "":
+				t.Errorf("Expected no error for a successful job, got %q", job.Error)
+			case test.err != nil && test.err != ErrManagerClosed && job.Error != test.err.Error():
+				t.Errorf("Expected error %q, got %q", test.err, job.Error)
+			}
+		})
+	}
+}
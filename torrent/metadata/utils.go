@@ -1,12 +1,102 @@
 package metadata
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/na--/winston/torrent/peer"
+
+	log "github.com/golang/glog"
+
+	"github.com/jackpal/bencode-go"
 )
 
-var outputFolder = flag.String("output_folder", "./tmp/", "Folder where you want to save the downloaded torrent files.")
+var outputFolder = flag.String("output_folder", defaultOutputFolder, "Folder where you want to save the downloaded torrent files.")
+var encryptionPolicy = flag.String("encryption", "prefer", "Encryption of peer connections: 'disabled', 'prefer' or 'require'.")
+var transports = flag.String("transports", "tcp", "Comma-separated list of transports for connecting to peers ('tcp' and/or 'utp'), tried in that order.")
+var parallelTransports = flag.Bool("parallel_transports", false, "Try all of the specified transports at the same time instead of one after the other.")
+var bindAddress = flag.String("bind_address", "", "Local IP address for outgoing peer connections (any if empty).")
+var socks5Proxy = flag.String("socks5_proxy", "", "SOCKS5 proxy (host:port) for all outgoing TCP peer connections (none if empty).")
+var socks5Username = flag.String("socks5_username", "", "Username for the SOCKS5 proxy, if it requires authentication.")
+var socks5Password = flag.String("socks5_password", "", "Password for the SOCKS5 proxy, if it requires authentication.")
+var dialTimeout = flag.Duration("dial_timeout", peer.DefaultOptions.DialTimeout, "Timeout for establishing connections to peers.")
+var listenAddress = flag.String("listen", "", "Address for accepting incoming peer connections, e.g. ':6881' (disabled if empty).")
+var dhtMinNodes = flag.Int("dht_min_nodes", defaultDHTMinNodes, "Minimum number of DHT nodes in the routing table before the DHT is considered bootstrapped.")
+var dhtBootstrapTimeout = flag.Duration("dht_bootstrap_timeout", defaultBootstrapTimeout, "Maximum time to wait for the DHT to bootstrap before starting the downloads.")
+var trackers = flag.String("trackers", "", "Comma-separated list of HTTP(S) and UDP tracker announce URLs to get peers from, in addition to the DHT.")
+var handshakeTimeout = flag.Duration("handshake_timeout", peer.DefaultOptions.HandshakeTimeout, "Timeout for the encryption and BitTorrent handshakes with peers.")
+var readTimeout = flag.Duration("read_timeout", peer.DefaultOptions.ReadTimeout, "Maximum time between two messages from a peer.")
+var writeTimeout = flag.Duration("write_timeout", peer.DefaultOptions.WriteTimeout, "Maximum time for sending a single message to a peer.")
+var maxMessageSize = flag.Int("max_message_size", peer.DefaultOptions.MaxMessageSize, "Maximum size of the messages from peers, in bytes.")
+var maxMetadataSize = flag.Int("max_metadata_size", peer.DefaultOptions.MaxMetadataSize, "Maximum size of the torrent metadata, in bytes.")
+var downloadTimeout = flag.Duration("download_timeout", defaultDownloadTimeout, "Timeout for downloading the metadata of a single torrent.")
+var maxDownloads = flag.Int("max_downloads", 0, "Maximum number of torrents that are downloaded at the same time, the rest wait in a queue (0 means no limit).")
+var maxPeersPerDownload = flag.Int("max_peers_per_download", defaultMaxPeersPerDownload, "Maximum number of simultaneous peer connections for a single torrent.")
+var maxPeerConnections = flag.Int("max_peer_connections", 0, "Maximum number of simultaneous peer connections for all torrents (0 means no limit).")
+var maxAttempts = flag.Int("max_attempts", defaultMaxAttempts, "Maximum number of download attempts for the torrents in a queue file, before they are marked as failed.")
+var minRetryDelay = flag.Duration("min_retry_delay", defaultMinRetryDelay, "Delay before the first retry of a failed download from a queue file, it's doubled after every attempt.")
+var maxRetryDelay = flag.Duration("max_retry_delay", defaultMaxRetryDelay, "Maximum delay between the retries of a failed download from a queue file.")
+var configFile = flag.String("config", "", "File with default values for the other options, one 'name = value' per line. Options from the command line take precedence.")
+
+// Creates a dialer for the comma-separated list of transports
+func makeDialer(transports string, parallel bool, config peer.DialerConfig) (dialer peer.Dialer, err error) {
+	var dialers []peer.Dialer
+	defer func() {
+		// The uTP sockets that were already created
+		if err != nil {
+			peer.FallbackDialer(dialers).Close()
+		}
+	}()
+
+	for _, transport := range strings.Split(transports, ",") {
+		switch strings.TrimSpace(transport) {
+		case "tcp":
+			tcpDialer, err := peer.NewDialer(config)
+			if err != nil {
+				return nil, err
+			}
+			dialers = append(dialers, tcpDialer)
+		case "utp":
+			if config.SOCKS5Proxy != "" {
+				// It would bypass the proxy
+				return nil, fmt.Errorf("The uTP transport can't be used with a SOCKS5 proxy")
+			}
+			utpDialer, err := peer.NewUTPDialer(net.JoinHostPort(config.LocalAddress, "0"))
+			if err != nil {
+				return nil, fmt.Errorf("Could not create uTP socket: %s", err)
+			}
+			dialers = append(dialers, utpDialer)
+		default:
+			return nil, fmt.Errorf("Unknown transport '%s'", transport)
+		}
+	}
+
+	if len(dialers) == 1 {
+		return dialers[0], nil
+	} else if parallel {
+		return peer.ParallelDialer(dialers), nil
+	}
+	return peer.FallbackDialer(dialers), nil
+}
+
+// Splits the comma-separated list of tracker URLs, ignoring empty ones
+func parseTrackers(list string) (result []string) {
+	for _, trackerURL := range strings.Split(list, ",") {
+		if trackerURL = strings.TrimSpace(trackerURL); trackerURL != "" {
+			result = append(result, trackerURL)
+		}
+	}
+	return
+}
 
 // This function accepts found peers in bulk through the in channel, buffers them
 // and passes them one by one to the out channel
@@ -21,6 +111,9 @@ func makePeerBuffer(in <-chan []string) <-chan string {
 		// If more are received meanwhile, add them to the slice :)
 		for chunkOfPeers := range in {
 			bufferedPeers = append(bufferedPeers, chunkOfPeers...)
+			if len(bufferedPeers) == 0 {
+				continue // Peer sources can find nothing as well
+			}
 		loop:
 			for {
 				select {
@@ -48,15 +141,59 @@ func makePeerBuffer(in <-chan []string) <-chan string {
 	return out
 }
 
-func saveMetaInfo(infoHash string, metadata []byte) (err error) {
+// The longest display name that is used in file names, in bytes
+const maxFileNameLength = 200
 
-	err = os.MkdirAll(*outputFolder, os.ModeDir|os.ModePerm)
+// Returns the file name for a torrent: "<display name>.<hex infohash>.torrent",
+// or just "<hex infohash>.torrent" if the display name is empty
+func torrentFileName(displayName, infoHash string) string {
+	name := strings.Map(func(r rune) rune {
+		// Path separators and the characters some file systems don't allow
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, displayName)
+	if len(name) > maxFileNameLength {
+		name = strings.ToValidUTF8(name[:maxFileNameLength], "")
+	}
+	// No hidden files, and Windows doesn't like trailing dots and spaces
+	name = strings.Trim(name, ". ")
+
+	if name == "" {
+		return fmt.Sprintf("%x.torrent", infoHash)
+	}
+	return fmt.Sprintf("%s.%x.torrent", name, infoHash)
+}
+
+// Returns the raw infohash from a file name made by torrentFileName
+func infoHashFromFileName(fileName string) (infoHash string, ok bool) {
+	name := strings.TrimSuffix(fileName, ".torrent")
+	if name == fileName {
+		return
+	}
+	decoded, err := hex.DecodeString(name[strings.LastIndex(name, ".")+1:])
+	if err != nil || len(decoded) != sha1Size {
+		return
+	}
+	return string(decoded), true
+}
+
+// Saves the torrent file, named after the display name if there is one. An
+// existing file for the same infohash is overwritten, whatever its name is.
+func saveMetaInfo(folder, displayName, infoHash string, metadata []byte) (err error) {
+
+	err = os.MkdirAll(folder, os.ModeDir|os.ModePerm)
 	if err != nil {
-		err = fmt.Errorf("Could not create folder '%s': %s", *outputFolder, err)
+		err = fmt.Errorf("Could not create folder '%s': %s", folder, err)
 		return
 	}
 
-	f, err := os.Create(fmt.Sprintf("%s/%x.torrent", *outputFolder, infoHash))
+	path, exists := SavedMetadata{folder}.find(infoHash)
+	if !exists {
+		path = filepath.Join(folder, torrentFileName(displayName, infoHash))
+	}
+	f, err := os.Create(path)
 	if err != nil {
 		err = fmt.Errorf("Error when opening file for creation: %s", err)
 		return
@@ -74,3 +211,124 @@ func saveMetaInfo(infoHash string, metadata []byte) (err error) {
 
 	return
 }
+
+// ReadTorrentFile returns the metadata (the info dictionary) from a torrent file
+// that was saved by Winston
+func ReadTorrentFile(path string) (metadata []byte, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if !bytes.HasPrefix(contents, []byte("d4:info")) || !bytes.HasSuffix(contents, []byte("e")) {
+		err = fmt.Errorf("Torrent file %s has an unknown format", path)
+		return
+	}
+	metadata = contents[len("d4:info") : len(contents)-1]
+	return
+}
+
+// Reads a torrent file that was saved by saveMetaInfo and returns the metadata in it
+func loadMetaInfo(folder, infoHash string) (metadata []byte, err error) {
+	metadata, err = ReadTorrentFile(SavedMetadata{folder}.Path(infoHash))
+	if err != nil {
+		return
+	}
+
+	for _, actualHash := range metadataInfoHashes(metadata) {
+		if actualHash == infoHash {
+			return
+		}
+	}
+	err = fmt.Errorf("Torrent file for %x does not match its infohash", infoHash)
+	metadata = nil
+	return
+}
+
+// Returns the infohashes of the metadata, as they are used in the DHT and the peer
+// protocols: the SHA-1 one for v1 torrents, the truncated SHA-256 one for v2
+// torrents and both of them for hybrid torrents (BEP52)
+func metadataInfoHashes(metadata []byte) (infoHashes []string) {
+	v1, v2 := true, false
+	if info, err := bencode.Decode(bytes.NewReader(metadata)); err == nil {
+		if dict, ok := info.(map[string]interface{}); ok {
+			if version, ok := dict["meta version"].(int64); ok && version == 2 {
+				v2 = true
+				_, v1 = dict["pieces"]
+			}
+		}
+	}
+
+	if v1 {
+		sum := sha1.Sum(metadata)
+		infoHashes = append(infoHashes, string(sum[:]))
+	}
+	if v2 {
+		sum := sha256.Sum256(metadata)
+		infoHashes = append(infoHashes, string(sum[:sha1Size]))
+	}
+	return
+}
+
+// SavedMetadata is a peer.MetadataStore that serves the torrent files
+// which were downloaded and saved in the output folder
+type SavedMetadata struct {
+	Folder string
+}
+
+// Load returns the saved metadata for the raw infohash, after checking that it matches it
+func (s SavedMetadata) Load(infoHash string) ([]byte, error) {
+	return loadMetaInfo(s.Folder, infoHash)
+}
+
+// Path returns where the torrent file for the raw infohash is saved. The file
+// name starts with the display name from the magnet link, if it had one.
+func (s SavedMetadata) Path(infoHash string) string {
+	path, _ := s.find(infoHash)
+	return path
+}
+
+// Returns the path of the existing torrent file for the infohash, or the one
+// without a display name if there is none
+func (s SavedMetadata) find(infoHash string) (path string, exists bool) {
+	path = filepath.Join(s.Folder, torrentFileName("", infoHash))
+	if _, err := os.Stat(path); err == nil {
+		return path, true
+	}
+
+	// The glob metacharacters in the folder name would break the pattern
+	matches, _ := filepath.Glob(filepath.Join(globEscape(s.Folder), fmt.Sprintf("*.%x.torrent", infoHash)))
+	if len(matches) > 0 {
+		return matches[0], true
+	}
+	return
+}
+
+func globEscape(path string) string {
+	return strings.NewReplacer(`*`, `[*]`, `?`, `[?]`, `[`, `[[]`).Replace(path)
+}
+
+// GetMetadata returns the saved metadata for the infohash or nil if we don't have it
+func (s SavedMetadata) GetMetadata(infoHash string) []byte {
+	metadata, err := loadMetaInfo(s.Folder, infoHash)
+	if err != nil {
+		log.V(3).Infof("WINSTON: Could not load metadata for %x: %s\n", infoHash, err)
+		return nil
+	}
+	return metadata
+}
+
+// InfoHashes returns the raw infohashes of all the saved torrent files
+func (s SavedMetadata) InfoHashes() (infoHashes []string) {
+	files, err := filepath.Glob(filepath.Join(globEscape(s.Folder), "*.torrent"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if infoHash, ok := infoHashFromFileName(filepath.Base(file)); ok {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTorrentFileName(t *testing.T) {
+	infoHash := "\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67"
+	const hexHash = "0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		displayName string
+		want        string
+	}{
+		{"", hexHash + ".torrent"},
+		{"Ubuntu 22.04 Desktop", "Ubuntu 22.04 Desktop." + hexHash + ".torrent"},
+		{"../../etc/passwd", "_.._etc_passwd." + hexHash + ".torrent"},
+		{`a\b:c*d?e"f<g>h|i` + "\x00\n", "a_b_c_d_e_f_g_h_i__." + hexHash + ".torrent"},
+		{" .hidden. ", "hidden." + hexHash + ".torrent"},
+		{"...", hexHash + ".torrent"},
+		{"Ünïcödé 名前", "Ünïcödé 名前." + hexHash + ".torrent"},
+		{strings.Repeat("é", 150), strings.Repeat("é", 100) + "." + hexHash + ".torrent"},
+	}
+
+	for _, test := range tests {
+		name := torrentFileName(test.displayName, infoHash)
+		if name != test.want {
+			t.Errorf("torrentFileName(%q) = %q, expected %q", test.displayName, name, test.want)
+		}
+		if parsed, ok := infoHashFromFileName(name); !ok || parsed != infoHash {
+			t.Errorf("Could not get the infohash back from %q", name)
+		}
+	}
+
+	for _, name := range []string{"notes.txt", "torrent", "abc.torrent", hexHash[2:] + ".torrent", hexHash + ".torrent.bak"} {
+		if _, ok := infoHashFromFileName(name); ok {
+			t.Errorf("Expected no infohash in %q", name)
+		}
+	}
+}
+
+func TestSavedMetadata(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "saved [1]")
+	saved := SavedMetadata{folder}
+	named, unnamed := []byte("d4:name5:first12:piece lengthi16384ee"), []byte("d4:name6:second12:piece lengthi16384ee")
+	namedHash, unnamedHash := metadataInfoHashes(named)[0], metadataInfoHashes(unnamed)[0]
+
+	if err := saveMetaInfo(folder, "First: the torrent", namedHash, named); err != nil {
+		t.Fatalf("Could not save the metadata: %s", err)
+	}
+	if err := saveMetaInfo(folder, "", unnamedHash, unnamed); err != nil {
+		t.Fatalf("Could not save the metadata: %s", err)
+	}
+	os.WriteFile(filepath.Join(folder, "notes.txt.torrent"), []byte("not a torrent"), 0644)
+
+	if path, want := saved.Path(namedHash), filepath.Join(folder, torrentFileName("First: the torrent", namedHash)); path != want {
+		t.Errorf("Expected path %s, got %s", want, path)
+	}
+	if path, want := saved.Path(unnamedHash), filepath.Join(folder, torrentFileName("", unnamedHash)); path != want {
+		t.Errorf("Expected path %s, got %s", want, path)
+	}
+	for infoHash, want := range map[string][]byte{namedHash: named, unnamedHash: unnamed} {
+		if metadata, err := saved.Load(infoHash); err != nil || string(metadata) != string(want) {
+			t.Errorf("Loaded %q (%v) for %x, expected %q", metadata, err, infoHash, want)
+		}
+	}
+
+	infoHashes := saved.InfoHashes()
+	sort.Strings(infoHashes)
+	want := []string{namedHash, unnamedHash}
+	sort.Strings(want)
+	if !reflect.DeepEqual(infoHashes, want) {
+		t.Errorf("Expected infohashes %x, got %x", want, infoHashes)
+	}
+
+	// Saving again under a different name overwrites the existing file
+	if err := saveMetaInfo(folder, "Renamed", namedHash, named); err != nil {
+		t.Fatalf("Could not save the metadata again: %s", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(globEscape(folder), "*.torrent")); len(files) != 3 {
+		t.Errorf("Expected 3 files after saving again, got %v", files)
+	}
+}
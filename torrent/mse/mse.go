@@ -0,0 +1,357 @@
+// Package mse implements the Message Stream Encryption (also known as Protocol Encryption)
+// handshake that BitTorrent clients use for obfuscating their connections.
+//
+// Specification: http://wiki.vuze.com/w/Message_Stream_Encryption
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// The crypto methods that can be negotiated with the handshake, they are used as
+// bit flags in the crypto_provide and crypto_select fields
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLength       = 96   // The length of the Diffie-Hellman public keys
+	maxPadLength    = 512  // The maximum length of the random paddings
+	maxIALength     = 1024 // The maximum length of the initial payload we accept
+	privateKeyBits  = 160
+	rc4DiscardBytes = 1024
+)
+
+var (
+	dhPrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+
+	// The verification constant, 8 zero bytes
+	vc = make([]byte, 8)
+)
+
+// Conn is a connection that went through the MSE handshake. Depending on the
+// negotiated method, data is either encrypted with RC4 or sent in plaintext.
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher
+	method  uint32
+}
+
+// Method returns the crypto method that was negotiated for the connection
+func (c *Conn) Method() uint32 {
+	return c.method
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+// HashSKey returns the value that identifies the shared secret (the torrent infohash)
+// during the handshake, without revealing it
+func HashSKey(skey []byte) []byte {
+	return hash([]byte("req2"), skey)
+}
+
+func hash(parts ...[]byte) []byte {
+	sha := sha1.New()
+	for _, part := range parts {
+		sha.Write(part)
+	}
+	return sha.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+func newRC4(keyName string, secret, skey []byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(hash([]byte(keyName), secret, skey))
+	if err != nil {
+		panic(fmt.Sprintf("Could not create RC4 cipher: %s", err))
+	}
+
+	discard := make([]byte, rc4DiscardBytes)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxPadLength+1))
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, n.Int64())
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// Returns the number as a big-endian byte slice with exactly keyLength bytes
+func toKeyBytes(n *big.Int) []byte {
+	result := make([]byte, keyLength)
+	b := n.Bytes()
+	copy(result[keyLength-len(b):], b)
+	return result
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (keys keyPair, err error) {
+	keys.private, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), privateKeyBits))
+	if err != nil {
+		return
+	}
+	keys.public = toKeyBytes(new(big.Int).Exp(dhGenerator, keys.private, dhPrime))
+	return
+}
+
+func (k keyPair) sharedSecret(theirPublic []byte) []byte {
+	return toKeyBytes(new(big.Int).Exp(new(big.Int).SetBytes(theirPublic), k.private, dhPrime))
+}
+
+// Sends our public key followed by a random padding
+func sendPublicKey(conn net.Conn, keys keyPair) error {
+	pad, err := randomPad()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(keys.public, pad...))
+	return err
+}
+
+// Reads from r until the pattern is found, giving up after maxBytes
+func synchronize(r *bufio.Reader, pattern []byte, maxBytes int) error {
+	window := make([]byte, 0, maxBytes)
+	for len(window) < maxBytes {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not synchronize with the remote peer in %d bytes", maxBytes)
+}
+
+// Reads a 2-byte length followed by that many bytes
+func readLengthPrefixed(r io.Reader, maxLength int) (data []byte, err error) {
+	var length uint16
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+	if int(length) > maxLength {
+		err = fmt.Errorf("Length %d is too large", length)
+		return
+	}
+	data = make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// Chooses a single method from the provided ones, encryption is preferred
+func selectMethod(provided, allowed uint32) uint32 {
+	if provided&allowed&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+	if provided&allowed&CryptoPlaintext != 0 {
+		return CryptoPlaintext
+	}
+	return 0
+}
+
+// Initiate performs the handshake for an outgoing connection. The skey is the infohash
+// of the torrent and provide is a combination of the crypto methods we support.
+// The remote peer selects one of them.
+func Initiate(conn net.Conn, skey []byte, provide uint32) (c *Conn, err error) {
+	keys, err := newKeyPair()
+	if err != nil {
+		return
+	}
+	if err = sendPublicKey(conn, keys); err != nil {
+		err = fmt.Errorf("Could not send public key: %w", err)
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	theirPublic := make([]byte, keyLength)
+	if _, err = io.ReadFull(br, theirPublic); err != nil {
+		err = fmt.Errorf("Could not read public key: %w", err)
+		return
+	}
+
+	secret := keys.sharedSecret(theirPublic)
+	encrypt := newRC4("keyA", secret, skey)
+	decrypt := newRC4("keyB", secret, skey)
+
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), secret))
+	msg.Write(xor(HashSKey(skey), hash([]byte("req3"), secret)))
+
+	var plain bytes.Buffer
+	plain.Write(vc)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // len(PadC)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // len(IA)
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	msg.Write(encrypted)
+
+	if _, err = conn.Write(msg.Bytes()); err != nil {
+		err = fmt.Errorf("Could not send crypto request: %w", err)
+		return
+	}
+
+	// The encrypted verification constant marks the end of their random padding
+	encryptedVC := make([]byte, len(vc))
+	decrypt.XORKeyStream(encryptedVC, vc)
+	if err = synchronize(br, encryptedVC, maxPadLength+len(vc)); err != nil {
+		err = fmt.Errorf("Could not find the verification constant: %w", err)
+		return
+	}
+
+	decrypted := cipher.StreamReader{S: decrypt, R: br}
+	var selected uint32
+	if err = binary.Read(decrypted, binary.BigEndian, &selected); err != nil {
+		err = fmt.Errorf("Could not read the selected crypto method: %w", err)
+		return
+	}
+	if _, err = readLengthPrefixed(decrypted, maxPadLength); err != nil {
+		err = fmt.Errorf("Could not read PadD: %w", err)
+		return
+	}
+
+	if selected&provide == 0 || (selected != CryptoRC4 && selected != CryptoPlaintext) {
+		err = fmt.Errorf("Remote peer selected an invalid crypto method %x", selected)
+		return
+	}
+
+	c = &Conn{Conn: conn, method: selected}
+	if selected == CryptoPlaintext {
+		c.reader = br
+	} else {
+		c.reader = decrypted
+		c.encrypt = encrypt
+	}
+	return
+}
+
+// Receive performs the handshake for an incoming connection. The lookup function
+// receives HashSKey() of the infohash that the remote peer wants and should return
+// the infohash itself, or nil if we don't know it. The allowed parameter is a
+// combination of the crypto methods we are willing to use.
+func Receive(conn net.Conn, lookup func(skeyHash []byte) []byte, allowed uint32) (c *Conn, skey []byte, err error) {
+	br := bufio.NewReader(conn)
+	theirPublic := make([]byte, keyLength)
+	if _, err = io.ReadFull(br, theirPublic); err != nil {
+		err = fmt.Errorf("Could not read public key: %w", err)
+		return
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return
+	}
+	if err = sendPublicKey(conn, keys); err != nil {
+		err = fmt.Errorf("Could not send public key: %w", err)
+		return
+	}
+
+	secret := keys.sharedSecret(theirPublic)
+	if err = synchronize(br, hash([]byte("req1"), secret), maxPadLength+sha1.Size); err != nil {
+		err = fmt.Errorf("Could not find the crypto request: %w", err)
+		return
+	}
+
+	obfuscatedSKeyHash := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(br, obfuscatedSKeyHash); err != nil {
+		err = fmt.Errorf("Could not read the infohash: %w", err)
+		return
+	}
+	skey = lookup(xor(obfuscatedSKeyHash, hash([]byte("req3"), secret)))
+	if skey == nil {
+		err = fmt.Errorf("Remote peer wants an unknown infohash")
+		return
+	}
+
+	decrypt := newRC4("keyA", secret, skey)
+	encrypt := newRC4("keyB", secret, skey)
+	decrypted := cipher.StreamReader{S: decrypt, R: br}
+
+	theirVC := make([]byte, len(vc))
+	if _, err = io.ReadFull(decrypted, theirVC); err != nil || !bytes.Equal(theirVC, vc) {
+		err = fmt.Errorf("Invalid verification constant (%v)", err)
+		return
+	}
+
+	var provided uint32
+	if err = binary.Read(decrypted, binary.BigEndian, &provided); err != nil {
+		err = fmt.Errorf("Could not read the provided crypto methods: %w", err)
+		return
+	}
+	if _, err = readLengthPrefixed(decrypted, maxPadLength); err != nil {
+		err = fmt.Errorf("Could not read PadC: %w", err)
+		return
+	}
+	initialPayload, err := readLengthPrefixed(decrypted, maxIALength)
+	if err != nil {
+		err = fmt.Errorf("Could not read the initial payload: %w", err)
+		return
+	}
+
+	selected := selectMethod(provided, allowed)
+	if selected == 0 {
+		err = fmt.Errorf("No acceptable crypto method in %x", provided)
+		return
+	}
+
+	var plain bytes.Buffer
+	plain.Write(vc)
+	binary.Write(&plain, binary.BigEndian, selected)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // len(PadD)
+	response := make([]byte, plain.Len())
+	encrypt.XORKeyStream(response, plain.Bytes())
+	if _, err = conn.Write(response); err != nil {
+		err = fmt.Errorf("Could not send the crypto response: %w", err)
+		return
+	}
+
+	c = &Conn{Conn: conn, method: selected}
+	if selected == CryptoPlaintext {
+		c.reader = io.MultiReader(bytes.NewReader(initialPayload), br)
+	} else {
+		c.reader = io.MultiReader(bytes.NewReader(initialPayload), decrypted)
+		c.encrypt = encrypt
+	}
+	return
+}
@@ -0,0 +1,162 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records everything that is written to the connection
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+func testInfoHash(name string) []byte {
+	sum := sha1.Sum([]byte(name))
+	return sum[:]
+}
+
+// Returns a lookup function that knows the specified infohashes
+func lookupFor(infoHashes ...[]byte) func(skeyHash []byte) []byte {
+	return func(skeyHash []byte) []byte {
+		for _, infoHash := range infoHashes {
+			if bytes.Equal(HashSKey(infoHash), skeyHash) {
+				return infoHash
+			}
+		}
+		return nil
+	}
+}
+
+type handshakeResult struct {
+	conn *Conn
+	skey []byte
+	err  error
+}
+
+// Runs both sides of the handshake over a pipe. The receiver's side is closed if
+// its handshake fails, so the initiator doesn't wait for it forever.
+func handshake(t *testing.T, skey []byte, provide uint32, lookup func([]byte) []byte, allowed uint32) (initiator, receiver handshakeResult, wire *recordingConn) {
+	a, b := net.Pipe()
+	wire = &recordingConn{Conn: a}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+
+	received := make(chan handshakeResult, 1)
+	go func() {
+		c, skey, err := Receive(b, lookup, allowed)
+		if err != nil {
+			b.Close()
+		}
+		received <- handshakeResult{c, skey, err}
+	}()
+
+	c, err := Initiate(wire, skey, provide)
+	if err != nil {
+		a.Close()
+	}
+	return handshakeResult{conn: c, err: err}, <-received, wire
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := testInfoHash("torrent")
+	other := testInfoHash("other torrent")
+
+	tests := []struct {
+		name       string
+		provide    uint32
+		known      [][]byte
+		allowed    uint32
+		wantMethod uint32 // 0 if the handshake should fail
+	}{
+		{"rc4 is preferred", CryptoRC4 | CryptoPlaintext, [][]byte{infoHash}, CryptoRC4 | CryptoPlaintext, CryptoRC4},
+		{"rc4 only", CryptoRC4, [][]byte{infoHash}, CryptoRC4, CryptoRC4},
+		{"plaintext only", CryptoPlaintext, [][]byte{infoHash}, CryptoRC4 | CryptoPlaintext, CryptoPlaintext},
+		{"receiver allows only plaintext", CryptoRC4 | CryptoPlaintext, [][]byte{other, infoHash}, CryptoPlaintext, CryptoPlaintext},
+		{"no common method", CryptoPlaintext, [][]byte{infoHash}, CryptoRC4, 0},
+		{"wrong skey", CryptoRC4 | CryptoPlaintext, [][]byte{other}, CryptoRC4 | CryptoPlaintext, 0},
+		{"no known skeys", CryptoRC4, nil, CryptoRC4, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initiator, receiver, wire := handshake(t, infoHash, test.provide, lookupFor(test.known...), test.allowed)
+
+			if test.wantMethod == 0 {
+				if initiator.err == nil || receiver.err == nil {
+					t.Fatalf("Expected the handshake to fail, got errors %v and %v", initiator.err, receiver.err)
+				}
+				return
+			}
+			if initiator.err != nil || receiver.err != nil {
+				t.Fatalf("Handshake failed: %v, %v", initiator.err, receiver.err)
+			}
+			if !bytes.Equal(receiver.skey, infoHash) {
+				t.Errorf("Receiver found skey %x, expected %x", receiver.skey, infoHash)
+			}
+			if initiator.conn.Method() != test.wantMethod || receiver.conn.Method() != test.wantMethod {
+				t.Errorf("Expected method %d, got %d and %d", test.wantMethod, initiator.conn.Method(), receiver.conn.Method())
+			}
+
+			// The data goes through in both directions, and it's only visible on the wire without encryption
+			for _, direction := range []struct {
+				name     string
+				from, to *Conn
+			}{{"initiator to receiver", initiator.conn, receiver.conn}, {"receiver to initiator", receiver.conn, initiator.conn}} {
+				message := []byte("\x13BitTorrent protocol, sent from the " + direction.name)
+				go direction.from.Write(message)
+				received := make([]byte, len(message))
+				if _, err := io.ReadFull(direction.to, received); err != nil {
+					t.Fatalf("Could not read the message from the %s: %s", direction.name, err)
+				}
+				if !bytes.Equal(received, message) {
+					t.Errorf("Received %q from the %s, expected %q", received, direction.name, message)
+				}
+			}
+			plaintextOnWire := bytes.Contains(wire.Written(), []byte("BitTorrent protocol"))
+			if plaintextOnWire != (test.wantMethod == CryptoPlaintext) {
+				t.Errorf("Plaintext message on the wire: %v, with method %d", plaintextOnWire, test.wantMethod)
+			}
+		})
+	}
+}
+
+func TestSelectMethod(t *testing.T) {
+	tests := []struct {
+		provided, allowed, want uint32
+	}{
+		{CryptoRC4 | CryptoPlaintext, CryptoRC4 | CryptoPlaintext, CryptoRC4},
+		{CryptoPlaintext, CryptoRC4 | CryptoPlaintext, CryptoPlaintext},
+		{CryptoRC4 | CryptoPlaintext, CryptoPlaintext, CryptoPlaintext},
+		{CryptoRC4, CryptoPlaintext, 0},
+		{0x04, CryptoRC4 | CryptoPlaintext, 0},
+	}
+	for _, test := range tests {
+		if got := selectMethod(test.provided, test.allowed); got != test.want {
+			t.Errorf("selectMethod(%x, %x) = %x, expected %x", test.provided, test.allowed, got, test.want)
+		}
+	}
+}
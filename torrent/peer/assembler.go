@@ -0,0 +1,281 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// Returns the number of ut_metadata pieces needed for metadata with the specified size
+func metadataPieceCount(metadataSize uint) int {
+	return int((metadataSize + metadataPieceSize - 1) / metadataPieceSize)
+}
+
+// Returns the infohash that is used in the DHT and the peer protocols. For v2
+// torrents, that's the SHA-256 infohash truncated to 20 bytes (BEP52).
+func wireInfoHash(infoHash string) string {
+	if len(infoHash) > sha1.Size {
+		return infoHash[:sha1.Size]
+	}
+	return infoHash
+}
+
+// VerifyMetadata checks if the metadata matches the infohash and returns the actual
+// hash. The infohash can be either a 20-byte SHA-1 (v1) infohash or a 32-byte
+// SHA-256 (v2) one. Hybrid torrents match both.
+func VerifyMetadata(infoHash string, metadata []byte) (actualHash string, ok bool) {
+	if len(infoHash) == sha256.Size {
+		sum := sha256.Sum256(metadata)
+		actualHash = string(sum[:])
+	} else {
+		sum := sha1.Sum(metadata)
+		actualHash = string(sum[:])
+	}
+	return actualHash, actualHash == infoHash
+}
+
+type assemblerPiece struct {
+	from        string          // The peer we received the piece from, empty if it's still missing
+	requestedBy map[string]bool // Peers that have an outstanding request for this piece
+}
+
+// Peers may disagree about the size of the metadata, so the pieces for each
+// advertised metadata_size are collected separately
+type metadataCandidate struct {
+	data     []byte
+	pieces   []assemblerPiece
+	received int
+}
+
+func newMetadataCandidate(size uint) *metadataCandidate {
+	c := &metadataCandidate{
+		data:   make([]byte, size),
+		pieces: make([]assemblerPiece, metadataPieceCount(size)),
+	}
+	for i := range c.pieces {
+		c.pieces[i].requestedBy = make(map[string]bool)
+	}
+	return c
+}
+
+// MetadataAssembler collects the metadata pieces of a single torrent from multiple
+// peers concurrently. Pieces that one peer failed to deliver are requested from
+// the others and the metadata is verified only once all the pieces are received.
+// Peers that sent pieces of metadata that did not match the infohash are
+// blacklisted.
+type MetadataAssembler struct {
+	infoHash string
+	options  *Options
+
+	mu         sync.Mutex
+	candidates map[uint]*metadataCandidate
+	strikes    map[string]int
+	blacklist  map[string]bool
+	changed    chan struct{} // Closed and replaced every time requested pieces are released
+	metadata   []byte
+	finisher   string // The peer whose piece completed the verified metadata
+	done       chan struct{}
+
+	discoveredPeers chan []PexPeer
+}
+
+// NewMetadataAssembler creates an empty assembler for the specified infohash, which
+// can be either a v1 or a full v2 infohash (see VerifyMetadata). If options is
+// nil, DefaultOptions are used for the peer connections.
+func NewMetadataAssembler(infoHash string, options *Options) *MetadataAssembler {
+	return &MetadataAssembler{
+		infoHash:   infoHash,
+		options:    getOptions(options),
+		candidates: make(map[uint]*metadataCandidate),
+		strikes:    make(map[string]int),
+		blacklist:  make(map[string]bool),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+
+		discoveredPeers: make(chan []PexPeer, discoveredPeersBuffer),
+	}
+}
+
+// DiscoveredPeers returns a channel with the peers for this torrent that the remote
+// peers told us about via Peer Exchange (BEP11). If nobody reads from it, new
+// peers are dropped once the channel's buffer is full.
+func (a *MetadataAssembler) DiscoveredPeers() <-chan []PexPeer {
+	return a.discoveredPeers
+}
+
+func (a *MetadataAssembler) addDiscoveredPeers(peers []PexPeer) {
+	select {
+	case a.discoveredPeers <- peers:
+	default:
+	}
+}
+
+// Done returns a channel that is closed once the metadata has been assembled and verified
+func (a *MetadataAssembler) Done() <-chan struct{} {
+	return a.done
+}
+
+// Metadata returns the verified metadata or nil if it's not yet complete
+func (a *MetadataAssembler) Metadata() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.metadata
+}
+
+// CompletedBy returns the address of the peer that sent the last piece of the
+// verified metadata, or an empty string if it's not yet complete
+func (a *MetadataAssembler) CompletedBy() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.finisher
+}
+
+// IsBlacklisted reports whether the peer has sent us bad metadata pieces
+func (a *MetadataAssembler) IsBlacklisted(remotePeer string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.blacklist[remotePeer]
+}
+
+// Returns a channel that will be closed when some requested pieces are released
+// and other peers may want to request them
+func (a *MetadataAssembler) changes() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.changed
+}
+
+// Should be called with the mutex held
+func (a *MetadataAssembler) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *MetadataAssembler) candidate(size uint) *metadataCandidate {
+	c, ok := a.candidates[size]
+	if !ok {
+		c = newMetadataCandidate(size)
+		a.candidates[size] = c
+	}
+	return c
+}
+
+// Returns the next piece that the peer should request. Pieces that nobody has
+// requested are preferred, but when there are none left, pieces requested from
+// other peers are returned as well, so slow peers don't hold up the download.
+func (a *MetadataAssembler) nextPiece(remotePeer string, size uint) (piece int, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.metadata != nil || a.blacklist[remotePeer] {
+		return
+	}
+
+	c := a.candidate(size)
+	piece = -1
+	for i, p := range c.pieces {
+		if p.from != "" || p.requestedBy[remotePeer] {
+			continue
+		}
+		if len(p.requestedBy) == 0 {
+			piece = i
+			break
+		}
+		if piece == -1 {
+			piece = i
+		}
+	}
+
+	if piece == -1 {
+		return 0, false
+	}
+
+	c.pieces[piece].requestedBy[remotePeer] = true
+	return piece, true
+}
+
+// Saves a received piece and verifies the metadata if it's complete. The returned
+// error is not nil only if the remote peer was blacklisted.
+func (a *MetadataAssembler) addPiece(remotePeer string, size uint, piece int, data []byte) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.candidate(size)
+	p := &c.pieces[piece]
+	delete(p.requestedBy, remotePeer)
+
+	if a.blacklist[remotePeer] {
+		return newError(ErrMetadataHashMismatch, nil, "Peer was blacklisted for sending bad metadata")
+	}
+
+	if a.metadata != nil || p.from != "" {
+		// We already have this piece, probably from another peer
+		return
+	}
+
+	copy(c.data[piece*metadataPieceSize:], data)
+	p.from = remotePeer
+	c.received++
+
+	if c.received < len(c.pieces) {
+		return
+	}
+
+	actualHash, ok := VerifyMetadata(a.infoHash, c.data)
+	if ok {
+		log.V(1).Infof("WINSTON: Assembled metadata for %x from %d pieces\n", a.infoHash, len(c.pieces))
+		a.metadata = c.data
+		a.finisher = remotePeer
+		close(a.done)
+		return
+	}
+
+	// Each peer that contributed to the bad metadata gets a strike. We can't know which of
+	// them sent the bad pieces, so they are blacklisted if they were the only contributor
+	// or if they were part of a bad assembly too many times.
+	contributors := make(map[string]bool)
+	for i := range c.pieces {
+		contributors[c.pieces[i].from] = true
+		c.pieces[i].from = ""
+	}
+	c.received = 0
+
+	log.V(2).Infof("WINSTON: Assembled metadata for %x has hash %x, blaming %d peers\n", a.infoHash, actualHash, len(contributors))
+
+	for contributor := range contributors {
+		a.strikes[contributor]++
+		if len(contributors) == 1 || a.strikes[contributor] >= maxAssemblerStrikes {
+			log.V(2).Infof("WINSTON: Blacklisting peer %s for torrent %x\n", contributor, a.infoHash)
+			a.blacklist[contributor] = true
+		}
+	}
+	a.notify()
+
+	if a.blacklist[remotePeer] {
+		err = newError(ErrMetadataHashMismatch, nil, fmt.Sprintf("Received metadata with hash %x, expected %x", actualHash, a.infoHash))
+	}
+	return
+}
+
+// Releases all pieces that the peer has requested but not delivered, so they
+// can be requested from other peers
+func (a *MetadataAssembler) release(remotePeer string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	released := false
+	for _, c := range a.candidates {
+		for i := range c.pieces {
+			if c.pieces[i].requestedBy[remotePeer] {
+				delete(c.pieces[i].requestedBy, remotePeer)
+				released = true
+			}
+		}
+	}
+	if released {
+		a.notify()
+	}
+}
@@ -0,0 +1,220 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Returns the ut_metadata piece of the metadata
+func metadataPiece(metadata []byte, piece int) []byte {
+	end := (piece + 1) * metadataPieceSize
+	if end > len(metadata) {
+		end = len(metadata)
+	}
+	return metadata[piece*metadataPieceSize : end]
+}
+
+func corruptPiece(data []byte) []byte {
+	bad := append([]byte(nil), data...)
+	bad[0] ^= 0xff
+	return bad
+}
+
+func isDone(a *MetadataAssembler) bool {
+	select {
+	case <-a.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAssemblerStrikes(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(2)
+	size := uint(len(metadata))
+
+	// A delivery is a piece from a peer, bad ones are corrupted
+	type delivery struct {
+		peer  string
+		piece int
+		bad   bool
+	}
+	tests := []struct {
+		name            string
+		deliveries      []delivery
+		wantDone        bool
+		wantBlacklisted []string
+		wantAllowed     []string
+	}{
+		{
+			name:        "good pieces from two peers",
+			deliveries:  []delivery{{"a", 0, false}, {"b", 1, false}},
+			wantDone:    true,
+			wantAllowed: []string{"a", "b"},
+		},
+		{
+			name:            "single peer sends a bad piece",
+			deliveries:      []delivery{{"a", 0, false}, {"a", 1, true}},
+			wantBlacklisted: []string{"a"},
+		},
+		{
+			name:        "one bad assembly from two peers is a strike for both",
+			deliveries:  []delivery{{"a", 0, true}, {"b", 1, false}},
+			wantAllowed: []string{"a", "b"},
+		},
+		{
+			name: "two bad assemblies blacklist the repeated contributors",
+			deliveries: []delivery{
+				{"a", 0, true}, {"b", 1, false},
+				{"a", 0, true}, {"c", 1, false},
+			},
+			wantBlacklisted: []string{"a"},
+			wantAllowed:     []string{"b", "c"},
+		},
+		{
+			name: "the metadata is completed after a bad assembly",
+			deliveries: []delivery{
+				{"a", 0, true}, {"b", 1, false},
+				{"c", 0, false}, {"b", 1, false},
+			},
+			wantDone:    true,
+			wantAllowed: []string{"a", "b", "c"},
+		},
+		{
+			name: "blacklisted peers can't contribute",
+			deliveries: []delivery{
+				{"a", 0, true}, {"a", 1, false},
+				{"a", 0, false}, {"a", 1, false},
+			},
+			wantBlacklisted: []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewMetadataAssembler(infoHash, nil)
+			for _, d := range test.deliveries {
+				data := metadataPiece(metadata, d.piece)
+				if d.bad {
+					data = corruptPiece(data)
+				}
+				wasBlacklisted := a.IsBlacklisted(d.peer)
+				err := a.addPiece(d.peer, size, d.piece, data)
+				if err != nil && !errors.Is(err, ErrMetadataHashMismatch) {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if (err != nil) != a.IsBlacklisted(d.peer) {
+					t.Errorf("addPiece from %s returned %v, but the peer's blacklisting is %v", d.peer, err, a.IsBlacklisted(d.peer))
+				}
+				if wasBlacklisted && err == nil {
+					t.Errorf("Blacklisted peer %s contributed a piece", d.peer)
+				}
+			}
+
+			if isDone(a) != test.wantDone {
+				t.Errorf("Expected the metadata to be complete: %v, got %v", test.wantDone, isDone(a))
+			}
+			if test.wantDone && !bytes.Equal(a.Metadata(), metadata) {
+				t.Errorf("Assembled metadata does not match")
+			}
+			for _, p := range test.wantBlacklisted {
+				if !a.IsBlacklisted(p) {
+					t.Errorf("Expected peer %s to be blacklisted", p)
+				}
+				if _, ok := a.nextPiece(p, size); ok {
+					t.Errorf("Blacklisted peer %s got a piece to request", p)
+				}
+			}
+			for _, p := range test.wantAllowed {
+				if a.IsBlacklisted(p) {
+					t.Errorf("Peer %s should not be blacklisted", p)
+				}
+			}
+		})
+	}
+}
+
+func TestAssemblerNextPiece(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(3)
+	size := uint(len(metadata))
+	a := NewMetadataAssembler(infoHash, nil)
+
+	next := func(peer string) int {
+		piece, ok := a.nextPiece(peer, size)
+		if !ok {
+			return -1
+		}
+		return piece
+	}
+
+	// Unrequested pieces go first
+	for _, want := range []struct {
+		peer  string
+		piece int
+	}{{"a", 0}, {"b", 1}, {"a", 2}} {
+		if piece := next(want.peer); piece != want.piece {
+			t.Fatalf("Expected piece %d for %s, got %d", want.piece, want.peer, piece)
+		}
+	}
+
+	// Then the pieces that other peers are slow to deliver
+	if piece := next("a"); piece != 1 {
+		t.Errorf("Expected piece 1 that b requested, got %d", piece)
+	}
+	if piece := next("a"); piece != -1 {
+		t.Errorf("Expected no more pieces for a, got %d", piece)
+	}
+
+	// Received pieces are not requested again
+	a.addPiece("b", size, 1, metadataPiece(metadata, 1))
+	if piece := next("c"); piece != 0 {
+		t.Errorf("Expected piece 0 for c, got %d", piece)
+	}
+	if piece := next("c"); piece != 2 {
+		t.Errorf("Expected piece 2 for c, got %d", piece)
+	}
+	if piece := next("c"); piece != -1 {
+		t.Errorf("Expected no more pieces for c, got %d", piece)
+	}
+
+	// Released pieces are requested by the others again, before the ones they already requested
+	changes := a.changes()
+	a.release("a")
+	select {
+	case <-changes:
+	default:
+		t.Errorf("Releasing the pieces of a did not notify the others")
+	}
+	a.addPiece("c", size, 0, metadataPiece(metadata, 0))
+	if piece := next("b"); piece != 2 {
+		t.Errorf("Expected piece 2 for b, got %d", piece)
+	}
+
+	a.addPiece("c", size, 2, metadataPiece(metadata, 2))
+	if !isDone(a) || !bytes.Equal(a.Metadata(), metadata) {
+		t.Fatalf("Expected the metadata to be complete")
+	}
+	if piece := next("d"); piece != -1 {
+		t.Errorf("Expected no pieces after the metadata is complete, got %d", piece)
+	}
+}
+
+func TestAssemblerSizeCandidates(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(2)
+	size := uint(len(metadata))
+	a := NewMetadataAssembler(infoHash, nil)
+
+	// A peer that lies about the size has its own candidate, which never verifies
+	wrongSize := size + metadataPieceSize
+	a.addPiece("liar", wrongSize, 0, metadataPiece(metadata, 0))
+	if piece, ok := a.nextPiece("honest", size); !ok || piece != 0 {
+		t.Errorf("Expected piece 0 for the real size, got %d (%v)", piece, ok)
+	}
+
+	a.addPiece("honest", size, 0, metadataPiece(metadata, 0))
+	a.addPiece("honest", size, 1, metadataPiece(metadata, 1))
+	if !isDone(a) || !bytes.Equal(a.Metadata(), metadata) {
+		t.Errorf("Expected the metadata to be complete")
+	}
+}
@@ -35,7 +35,28 @@ const (
 
 const (
 	winstonExtensionUtMetadata = 1 + iota
+	winstonExtensionUtPex
 )
 
+// All ut_metadata pieces except the last one have this size (BEP09)
+const metadataPieceSize = 16 * 1024
+
+// The default limits for the sizes of peer messages and torrent metadata
+const (
+	defaultMaxMessageSize  = 130 * 1024
+	defaultMaxMetadataSize = 2 * 1024 * 1024
+)
+
+// How many metadata piece requests we keep in flight if the peer did not
+// specify its own limit with the reqq field in the extension handshake
+const defaultMaxOutstandingRequests = 16
+
+// How many times a peer can contribute to assembled metadata with a wrong hash
+// before it gets blacklisted by the MetadataAssembler
+const maxAssemblerStrikes = 2
+
+// How many batches of peers found via PEX can wait for the MetadataAssembler's user
+const discoveredPeersBuffer = 32
+
 var bitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 	'r', 'e', 'n', 't', ' ', 'p', 'r', 'o', 't', 'o', 'c', 'o', 'l'}
@@ -0,0 +1,171 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/anacrolix/utp"
+)
+
+// Dialer is used for making outgoing connections to peers. The network passed to it
+// is always "tcp", but implementations are free to use a different transport, as
+// long as the returned connection behaves like a stream. Dial timeouts are applied
+// through the context, so dialers don't need to implement them on their own.
+// Dialers that hold resources, like UTPDialer, implement io.Closer as well.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// TCPDialer is the default Dialer, it makes plain TCP connections
+var TCPDialer Dialer = &net.Dialer{}
+
+// DialerConfig describes how the connections made by NewDialer should be routed
+type DialerConfig struct {
+	LocalAddress   string // Local IP address to bind outgoing connections to, any if empty
+	SOCKS5Proxy    string // Address (host:port) of a SOCKS5 proxy for all connections, none if empty
+	SOCKS5Username string
+	SOCKS5Password string
+}
+
+// NewDialer returns a TCP Dialer that binds connections to the local address and/or
+// sends them through a SOCKS5 proxy, as specified in the config
+func NewDialer(config DialerConfig) (Dialer, error) {
+	dialer := &net.Dialer{}
+	if config.LocalAddress != "" {
+		ip := net.ParseIP(config.LocalAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid local address '%s'", config.LocalAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if config.SOCKS5Proxy == "" {
+		return dialer, nil
+	}
+
+	return &SOCKS5Dialer{
+		ProxyAddress: config.SOCKS5Proxy,
+		Username:     config.SOCKS5Username,
+		Password:     config.SOCKS5Password,
+		Forward:      dialer,
+	}, nil
+}
+
+// UTPDialer makes uTP (BEP29) connections over a single shared UDP socket
+type UTPDialer struct {
+	socket *utp.Socket
+}
+
+// NewUTPDialer creates a UDP socket on the specified local address (e.g. ":0" for
+// a random port) that will be used for all uTP connections made by the dialer
+func NewUTPDialer(localAddress string) (*UTPDialer, error) {
+	socket, err := utp.NewSocket("udp", localAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &UTPDialer{socket}, nil
+}
+
+// DialContext makes a new uTP connection; the network is ignored
+func (d *UTPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.socket.DialContext(ctx, "", address)
+}
+
+// Close closes the underlying UDP socket
+func (d *UTPDialer) Close() error {
+	return d.socket.Close()
+}
+
+// FallbackDialer tries its dialers one after the other and returns the first
+// connection that succeeds
+type FallbackDialer []Dialer
+
+// DialContext tries to connect with each dialer in order
+func (dialers FallbackDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	var errs []string
+	for _, dialer := range dialers {
+		conn, err = dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, joinDialErrors(errs)
+}
+
+// ParallelDialer tries all of its dialers at the same time and returns the first
+// connection that succeeds, closing the rest
+type ParallelDialer []Dialer
+
+// DialContext races all the dialers against each other
+func (dialers ParallelDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(dialers))
+	for _, dialer := range dialers {
+		go func(dialer Dialer) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			results <- dialResult{conn, err}
+		}(dialer)
+	}
+
+	var winner net.Conn
+	var errs []string
+	for range dialers {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, result.err.Error())
+		} else if winner == nil {
+			winner = result.conn
+			cancel()
+		} else {
+			result.conn.Close()
+		}
+	}
+
+	if winner == nil {
+		return nil, joinDialErrors(errs)
+	}
+	return winner, nil
+}
+
+// Close closes the dialers that implement io.Closer
+func (dialers FallbackDialer) Close() error {
+	return closeDialers(dialers)
+}
+
+// Close closes the dialers that implement io.Closer
+func (dialers ParallelDialer) Close() error {
+	return closeDialers(dialers)
+}
+
+func closeDialers(dialers []Dialer) (err error) {
+	for _, dialer := range dialers {
+		if closer, ok := dialer.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return
+}
+
+func joinDialErrors(errs []string) error {
+	if len(errs) == 0 {
+		return errors.New("No dialers were specified")
+	}
+	return fmt.Errorf("All dialers failed: %s", strings.Join(errs, "; "))
+}
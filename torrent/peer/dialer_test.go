@@ -0,0 +1,66 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// A dialer that only records if it was closed
+type closingDialer struct {
+	closed bool
+	err    error
+}
+
+func (d *closingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (d *closingDialer) Close() error {
+	d.closed = true
+	return d.err
+}
+
+func TestCombinedDialersClose(t *testing.T) {
+	closeErr := errors.New("close failed")
+
+	for _, name := range []string{"fallback", "parallel"} {
+		t.Run(name, func(t *testing.T) {
+			first, failing, last := &closingDialer{}, &closingDialer{err: closeErr}, &closingDialer{}
+			dialers := []Dialer{first, TCPDialer, failing, last}
+
+			var err error
+			if name == "fallback" {
+				err = FallbackDialer(dialers).Close()
+			} else {
+				err = ParallelDialer(dialers).Close()
+			}
+			if err != closeErr {
+				t.Errorf("Expected the error of the failing dialer, got %v", err)
+			}
+			// A failed Close doesn't stop the rest
+			if !first.closed || !failing.closed || !last.closed {
+				t.Errorf("Not all dialers were closed: %v, %v, %v", first.closed, failing.closed, last.closed)
+			}
+		})
+	}
+}
+
+func TestUTPDialerClose(t *testing.T) {
+	dialer, err := NewUTPDialer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not create the uTP dialer: %s", err)
+	}
+	if err = (FallbackDialer{TCPDialer, dialer}).Close(); err != nil {
+		t.Fatalf("Could not close the dialers: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if conn, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		conn.Close()
+		t.Errorf("Dialed through a closed uTP socket")
+	}
+}
@@ -0,0 +1,62 @@
+package peer
+
+import (
+	"errors"
+	"net"
+)
+
+// These are the different kinds of failures that can happen while downloading metadata
+// from a peer. All errors returned by this package can be checked against them with errors.Is
+var (
+	ErrConnectionFailed          = errors.New("Could not connect to the peer")
+	ErrHandshakeFailed           = errors.New("BitTorrent handshake with the peer failed")
+	ErrEncryptionFailed          = errors.New("Encrypted handshake with the peer failed")
+	ErrWrongInfoHash             = errors.New("Peer responded with a different infohash")
+	ErrNoExtensionProtocol       = errors.New("Peer does not support the extension protocol (BEP10)")
+	ErrInvalidExtensionHandshake = errors.New("Peer sent an invalid extension handshake")
+	ErrNoMetadataExtension       = errors.New("Peer does not support the metadata extension (BEP09)")
+	ErrInvalidMetadataSize       = errors.New("Peer advertised an invalid metadata size")
+	ErrMetadataRejected          = errors.New("Peer rejected our request for metadata")
+	ErrInvalidMessage            = errors.New("Peer sent an invalid or unexpected message")
+	ErrMetadataHashMismatch      = errors.New("Received metadata does not match the infohash")
+	ErrConnectionLost            = errors.New("Connection to the peer was lost")
+	ErrAborted                   = errors.New("Download was aborted")
+
+	// ErrTimeout matches every error that was caused by a network timeout,
+	// regardless of its kind
+	ErrTimeout = errors.New("Peer timed out")
+)
+
+// Error describes a failed metadata download from a peer
+type Error struct {
+	Kind    error  // One of the Err* values above
+	Details string // Human readable description of what happened
+	Err     error  // The underlying error, if any
+}
+
+func newError(kind error, cause error, details string) *Error {
+	return &Error{Kind: kind, Details: details, Err: cause}
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return e.Kind.Error()
+	}
+	return e.Details
+}
+
+// Unwrap returns the underlying error, so errors.As can be used to inspect it
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the specified kind
+func (e *Error) Is(target error) bool {
+	return target == e.Kind || (target == ErrTimeout && e.Timeout())
+}
+
+// Timeout reports whether the error was caused by a network timeout
+func (e *Error) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,145 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// Listener accepts incoming BitTorrent connections. Peers that want metadata we
+// have in the store are served, while peers that connect to us for torrents we are
+// still looking for are used to download the metadata.
+type Listener struct {
+	listener net.Listener
+	store    MetadataStore
+	options  *Options
+
+	mu     sync.Mutex
+	wanted map[string]*MetadataAssembler
+}
+
+// Listen starts listening for incoming TCP connections on the specified address.
+// The store can be nil if we don't want to serve metadata to other peers.
+// If options is nil, DefaultOptions are used.
+func Listen(address string, store MetadataStore, options *Options) (l *Listener, err error) {
+	netListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+
+	l = &Listener{
+		listener: netListener,
+		store:    store,
+		options:  getOptions(options),
+		wanted:   make(map[string]*MetadataAssembler),
+	}
+	return
+}
+
+// Addr returns the address the listener accepts connections on
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Want registers an assembler for an infohash whose metadata we are looking for.
+// Pieces received from peers that connect to us for that torrent are added to it.
+func (l *Listener) Want(infoHash string, assembler *MetadataAssembler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.wanted[wireInfoHash(infoHash)] = assembler
+}
+
+// Unwant removes an infohash previously registered with Want
+func (l *Listener) Unwant(infoHash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.wanted, wireInfoHash(infoHash))
+}
+
+func (l *Listener) getWanted(infoHash string) *MetadataAssembler {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wanted[infoHash]
+}
+
+// Returns all the infohashes that we can accept encrypted connections for
+func (l *Listener) knownInfoHashes() (infoHashes []string) {
+	if lister, ok := l.store.(InfoHashLister); ok {
+		infoHashes = lister.InfoHashes()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for infoHash := range l.wanted {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return
+}
+
+// Serve accepts incoming connections until ctx is cancelled or the listener is closed.
+// Every connection is handled in its own goroutine.
+func (l *Listener) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.listener.Close()
+	}()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go l.handleConnection(ctx, conn)
+	}
+}
+
+// Close stops the listener; connections that are already accepted are not affected
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) handleConnection(ctx context.Context, conn net.Conn) (err error) {
+	ourPeerID := NewPeerID()
+	remotePeer := conn.RemoteAddr().String()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closeOnDone(ctx, conn)
+
+	var metadata []byte
+	var assembler *MetadataAssembler
+	isKnown := func(infoHash string) bool {
+		if l.store != nil {
+			metadata = l.store.GetMetadata(infoHash)
+		}
+		if metadata == nil {
+			assembler = l.getWanted(infoHash)
+			if assembler != nil {
+				// It's possible that the metadata was downloaded from someone else in the meantime
+				metadata = assembler.Metadata()
+			}
+		}
+		return metadata != nil || assembler != nil
+	}
+
+	conn, _, theirInfoHash, theirPeerID, err := acceptConnectionFromPeer(conn, ourPeerID, isKnown, l.knownInfoHashes, l.options)
+	if err != nil {
+		log.V(2).Infof("WINSTON (peer %s): Refused connection from %s: '%s'\n", ourPeerID, remotePeer, err)
+		return
+	}
+
+	if metadata != nil {
+		log.V(2).Infof("WINSTON (peer %s): Serving metadata for %x to %s (%q)\n", ourPeerID, theirInfoHash, remotePeer, theirPeerID)
+		err = serveMetadataSession(ctx, conn, ourPeerID, remotePeer, metadata, l.options)
+	} else {
+		log.V(2).Infof("WINSTON (peer %s): Peer %s (%q) connected to us with wanted torrent %x\n", ourPeerID, remotePeer, theirPeerID, theirInfoHash)
+		_, err = assembler.downloadSession(ctx, conn, ourPeerID, remotePeer)
+	}
+	log.V(2).Infof("WINSTON (peer %s): Incoming connection from %s finished: %s\n", ourPeerID, remotePeer, err)
+	return
+}
@@ -0,0 +1,88 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts a listener on a random local port that is closed at the end of the test
+func startTestListener(t *testing.T, store MetadataStore, options *Options) *Listener {
+	l, err := Listen("127.0.0.1:0", store, options)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go l.Serve(ctx)
+	return l
+}
+
+// Answers the metadata requests until the connection is closed
+func (p *fakePeer) servePieces(metadata []byte) {
+	for piece := range p.readRequests() {
+		if err := p.sendPiece(piece, metadata); err != nil {
+			return
+		}
+	}
+}
+
+func TestListenerDownloadsFromIncomingPeers(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(3)
+	l := startTestListener(t, nil, nil)
+	assembler := NewMetadataAssembler(infoHash, nil)
+	l.Want(infoHash, assembler)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to the listener: %s", err)
+	}
+	defer conn.Close()
+
+	// A seed that connects to us with the plaintext handshake
+	if _, err := conn.Write(getSessionHeader(infoHash, NewPeerID())); err != nil {
+		t.Fatalf("Could not send the header: %s", err)
+	}
+	header, err := readHeader(conn)
+	if err != nil {
+		t.Fatalf("Could not read the header: %s", err)
+	}
+	if string(header[8:28]) != infoHash {
+		t.Fatalf("Listener replied with infohash %x, expected %x", header[8:28], infoHash)
+	}
+	fake := &fakePeer{t, conn}
+	fake.exchangeExtensionHandshakes(len(metadata), 0)
+	go fake.servePieces(metadata)
+
+	select {
+	case <-assembler.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The metadata was not downloaded from the incoming peer")
+	}
+	if !bytes.Equal(assembler.Metadata(), metadata) {
+		t.Errorf("Assembled metadata does not match")
+	}
+	// The peer is reported with its real address
+	if from := assembler.CompletedBy(); from != conn.LocalAddr().String() {
+		t.Errorf("Expected the metadata to be completed by %s, got %q", conn.LocalAddr(), from)
+	}
+}
+
+func TestListenerRefusesUnknownInfoHashes(t *testing.T) {
+	_, infoHash := makeTestMetadata(1)
+	l := startTestListener(t, nil, nil)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to the listener: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write(getSessionHeader(infoHash, NewPeerID()))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if header, err := readHeader(conn); err == nil {
+		t.Errorf("Listener replied with header %x for an unknown infohash", header)
+	}
+}
@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"fmt"
+	"time"
+)
+
+// EncryptionPolicy controls the usage of Message Stream Encryption for peer connections
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisabled means that only plaintext connections are used
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPreferred means that outgoing connections are encrypted if the remote
+	// peer supports it, and both kinds of incoming connections are accepted
+	EncryptionPreferred
+	// EncryptionRequired means that only encrypted connections are used
+	EncryptionRequired
+)
+
+// ParseEncryptionPolicy converts "disabled", "prefer" or "require" to an EncryptionPolicy
+func ParseEncryptionPolicy(s string) (policy EncryptionPolicy, err error) {
+	switch s {
+	case "disabled":
+		policy = EncryptionDisabled
+	case "prefer":
+		policy = EncryptionPreferred
+	case "require":
+		policy = EncryptionRequired
+	default:
+		err = fmt.Errorf("Unknown encryption policy '%s'", s)
+	}
+	return
+}
+
+// Options control how the connections with other peers are made
+type Options struct {
+	Encryption       EncryptionPolicy
+	Dialer           Dialer        // Used for all outgoing connections, TCPDialer if nil
+	DialTimeout      time.Duration // How long the dialer has to establish a connection, 0 means no limit
+	HandshakeTimeout time.Duration // How long the encryption and BitTorrent handshakes can take, 0 means no limit
+	ReadTimeout      time.Duration // Maximum time between two messages from the peer, 0 means no limit
+	WriteTimeout     time.Duration // Maximum time for sending a single message, 0 means no limit
+	MaxMessageSize   int           // Larger messages from peers are refused, defaultMaxMessageSize if 0
+	MaxMetadataSize  int           // Larger metadata is refused, defaultMaxMetadataSize if 0
+}
+
+// DefaultOptions are used everywhere nil options are passed
+var DefaultOptions = Options{
+	Encryption:       EncryptionPreferred,
+	Dialer:           TCPDialer,
+	DialTimeout:      5 * time.Second,
+	HandshakeTimeout: 20 * time.Second,
+	ReadTimeout:      60 * time.Second,
+	WriteTimeout:     30 * time.Second,
+	MaxMessageSize:   defaultMaxMessageSize,
+	MaxMetadataSize:  defaultMaxMetadataSize,
+}
+
+func (o *Options) dialer() Dialer {
+	if o.Dialer == nil {
+		return TCPDialer
+	}
+	return o.Dialer
+}
+
+func (o *Options) maxMessageSize() int {
+	if o.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return o.MaxMessageSize
+}
+
+func (o *Options) maxMetadataSize() int {
+	if o.MaxMetadataSize <= 0 {
+		return defaultMaxMetadataSize
+	}
+	return o.MaxMetadataSize
+}
+
+// Returns the deadline for an operation that should finish in the specified
+// time, or the zero time (no deadline) if the timeout is not positive
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func getOptions(options *Options) *Options {
+	if options == nil {
+		return &DefaultOptions
+	}
+	return options
+}
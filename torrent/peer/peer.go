@@ -6,16 +6,18 @@
 package peer
 
 import (
-	"crypto/sha1"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"time"
 
 	log "github.com/golang/glog"
 )
 
-func createPeerReader(conn net.Conn) (<-chan []byte, <-chan error) {
+// The reader goroutine exits when the connection is closed or when done is closed,
+// so it never stays blocked on its unbuffered channels after the session is over
+func createPeerReader(conn net.Conn, done <-chan struct{}, options *Options) (<-chan []byte, <-chan error) {
 	msgChan := make(chan []byte)
 	errChan := make(chan error)
 
@@ -25,41 +27,53 @@ func createPeerReader(conn net.Conn) (<-chan []byte, <-chan error) {
 		defer close(msgChan)
 		defer close(errChan)
 
+		sendErr := func(err error) {
+			select {
+			case errChan <- err:
+			case <-done:
+			}
+		}
+
 		for {
 			// Set a deadline for receiving the next message and refresh it before each message
-			conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+			conn.SetReadDeadline(deadline(options.ReadTimeout))
 
 			var n uint32
 			n, err := netReadUint32(conn)
 			if err != nil {
-				errChan <- fmt.Errorf("Could not read first byte of new message: '%s'", err)
+				sendErr(newError(ErrConnectionLost, err, fmt.Sprintf("Could not read first byte of new message: '%s'", err)))
 				break
 			}
-			if n > 130*1024 {
-				errChan <- fmt.Errorf("Received message was too large: %d", n)
+			if n > uint32(options.maxMessageSize()) {
+				sendErr(newError(ErrInvalidMessage, nil, fmt.Sprintf("Received message was too large: %d", n)))
 				break
 			}
 
-			var buf []byte
-			if n == 0 {
-				// keep-alive - we want an empty message
-				buf = make([]byte, 1)
-			} else {
-				buf = make([]byte, n)
+			// A keep-alive has no body, it's passed on as an empty message
+			buf := make([]byte, n)
+			if n > 0 {
+				_, err = io.ReadFull(conn, buf)
+				if err != nil {
+					sendErr(newError(ErrConnectionLost, err, fmt.Sprintf("Could not get the whole mssage: '%s'", err)))
+					break
+				}
 			}
 
-			_, err = io.ReadFull(conn, buf)
-			if err != nil {
-				errChan <- fmt.Errorf("Could not get the whole mssage: '%s'", err)
+			select {
+			case msgChan <- buf:
+			case <-done:
+				return
 			}
-			msgChan <- buf
 		}
 	}()
 
 	return msgChan, errChan
 }
 
-func createPeerWriter(conn net.Conn) (chan<- []byte, <-chan error) {
+// The writer goroutine exits when the caller closes the returned message channel.
+// After a write error it keeps draining (and discarding) messages, so the caller
+// never blocks when sending to it.
+func createPeerWriter(conn net.Conn, done <-chan struct{}, options *Options) (chan<- []byte, <-chan error) {
 	msgChan := make(chan []byte)
 	errChan := make(chan error)
 
@@ -68,19 +82,26 @@ func createPeerWriter(conn net.Conn) (chan<- []byte, <-chan error) {
 		defer close(errChan)
 		// msgChan should be closed by the caller
 
+		var err *Error
 		for msg := range msgChan {
+			if err != nil {
+				continue
+			}
+
 			// Set a deadline for sending the next message and refresh it before each message
-			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			conn.SetWriteDeadline(deadline(options.WriteTimeout))
 
-			err := netWriteUint32(conn, uint32(len(msg)))
-			if err != nil {
-				errChan <- fmt.Errorf("Could not send byte of new message: '%s'", err)
-				break
+			if writeErr := netWriteUint32(conn, uint32(len(msg))); writeErr != nil {
+				err = newError(ErrConnectionLost, writeErr, fmt.Sprintf("Could not send byte of new message: '%s'", writeErr))
+			} else if _, writeErr = conn.Write(msg); writeErr != nil {
+				err = newError(ErrConnectionLost, writeErr, fmt.Sprintf("Could not send a message: '%s'", writeErr))
 			}
-			_, err = conn.Write(msg)
+
 			if err != nil {
-				errChan <- fmt.Errorf("Could not send a message: '%s'", err)
-				break
+				select {
+				case errChan <- err:
+				case <-done:
+				}
 			}
 		}
 	}()
@@ -89,13 +110,51 @@ func createPeerWriter(conn net.Conn) (chan<- []byte, <-chan error) {
 }
 
 // DownloadMetadataFromPeer is used to connect to the specified peer
-// and download the torrent metadata for the specified infoHash from them
-func DownloadMetadataFromPeer(remotePeer, infoHash string) (downloadedTorrent []byte) {
-	ourPeerID := getNewPeerID()
+// and download the torrent metadata for the specified infoHash from them.
+// The infohash is the raw 20-byte v1 infohash or the raw 32-byte v2 one.
+// If the download fails, the returned error is an *Error that can be
+// compared with the Err* values via errors.Is.
+func DownloadMetadataFromPeer(remotePeer, infoHash string) (downloadedTorrent []byte, err error) {
+	return DownloadMetadataFromPeerContext(context.Background(), remotePeer, infoHash)
+}
+
+// DownloadMetadataFromPeerContext is the same as DownloadMetadataFromPeer, but the
+// download can be aborted by cancelling ctx. When that happens, the connection is
+// closed and the function returns promptly with an ErrAborted error.
+func DownloadMetadataFromPeerContext(ctx context.Context, remotePeer, infoHash string) (downloadedTorrent []byte, err error) {
+	return NewMetadataAssembler(infoHash, nil).DownloadFromPeer(ctx, remotePeer)
+}
+
+// DownloadFromPeer connects to the specified peer and downloads metadata pieces from
+// them until the assembler has the complete metadata, the peer fails or ctx is cancelled.
+// It's safe to call it concurrently for multiple peers, they will share the work.
+// Once the metadata is complete, every call returns it, even if the peer did not
+// contribute any pieces.
+func (a *MetadataAssembler) DownloadFromPeer(ctx context.Context, remotePeer string) (downloadedTorrent []byte, err error) {
+	ourPeerID := NewPeerID()
+	infoHash := a.infoHash
+
+	// Everything related to this session (the connection and its reader and
+	// writer goroutines) is torn down once this context is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Errors caused by closing the connection because the parent context was
+	// cancelled are reported as such. This runs before the deferred cancel() above.
+	defer func() {
+		if err != nil && ctx.Err() != nil && !errors.Is(err, ErrAborted) {
+			err = newError(ErrAborted, ctx.Err(), fmt.Sprintf("Download was aborted (%s)", ctx.Err()))
+		}
+	}()
+
+	if a.IsBlacklisted(remotePeer) {
+		err = newError(ErrMetadataHashMismatch, nil, "Peer was blacklisted for sending bad metadata")
+		return
+	}
 
 	log.V(2).Infof("WINSTON (peer %s): Connecting to %s for torrent %x\n", ourPeerID, remotePeer, infoHash)
 
-	conn, theirFlags, theirInfoHash, theirPeerID, err := initiateConnectionToPeer(remotePeer, ourPeerID, infoHash)
+	conn, theirFlags, theirInfoHash, theirPeerID, err := initiateConnectionToPeer(ctx, remotePeer, ourPeerID, wireInfoHash(infoHash), a.options)
 	if err != nil {
 		log.V(2).Infof("WINSTON (peer %s): Error connecting to peer %s: '%s'\n", ourPeerID, remotePeer, err)
 		return
@@ -103,38 +162,68 @@ func DownloadMetadataFromPeer(remotePeer, infoHash string) (downloadedTorrent []
 	defer conn.Close()
 	log.V(2).Infof("WINSTON (peer %s): Connection successful! Remote peer %s is %q, has torrent '%x' and flags '%x'\n", ourPeerID, remotePeer, theirPeerID, theirInfoHash, theirFlags)
 
-	readChan, readErrors := createPeerReader(conn)
-	writeChan, writeErrors := createPeerWriter(conn)
+	return a.downloadSession(ctx, conn, ourPeerID, remotePeer)
+}
+
+// Runs the BEP10 exchange and downloads metadata pieces over an already established
+// connection, regardless of which side initiated it. ctx should be cancelled by the
+// caller once the session is over.
+func (a *MetadataAssembler) downloadSession(ctx context.Context, conn net.Conn, ourPeerID, remotePeer string) (downloadedTorrent []byte, err error) {
+	infoHash := a.infoHash
+
+	readChan, readErrors := createPeerReader(conn, ctx.Done(), a.options)
+	writeChan, writeErrors := createPeerWriter(conn, ctx.Done(), a.options)
 	//TODO: add keep alive ticker
 	defer close(writeChan)
 
+	// Let other peers request the pieces that we did not receive
+	defer a.release(remotePeer)
+
 	// Send the BEP10 handshake message
-	writeChan <- getExtensionsHandshakeMsg()
+	writeChan <- getExtensionsHandshakeMsg(len(a.Metadata()))
 
 	//TODO: refactor method, this is getting too long and complicated
 
 	receivedHandshakeInfo := false
-	expectedMetadataPiece := 0
 
 	// These will be initialized once we receive the extension handshake
 	var theirExtensionHandshake extensionHandshake
-	var receivedMetadata []byte
-	var totalPieces int
+	var maxOutstandingRequests int
+	outstandingPieces := make(map[int]bool)
+
+	// Requests as many pieces as the peer allows us to have in flight
+	requestMorePieces := func() {
+		for len(outstandingPieces) < maxOutstandingRequests {
+			piece, ok := a.nextPiece(remotePeer, theirExtensionHandshake.MetadataSize)
+			if !ok {
+				return
+			}
+			outstandingPieces[piece] = true
+			writeChan <- getMetadataRequestPieceMsg(piece, theirExtensionHandshake.M["ut_metadata"])
+		}
+	}
+
+	changes := a.changes()
 
 	for {
 		select {
 		case newMessage, chanOk := <-readChan:
 			if !chanOk {
 				log.V(2).Infof("WINSTON (peer %s): Reader channel unexpectedly closed!\n", ourPeerID)
+				err = newError(ErrConnectionLost, nil, "Reader channel unexpectedly closed")
 				return
 			}
 
 			log.V(3).Infof("WINSTON (peer %s): Received new message from %s: %q\n", ourPeerID, remotePeer, newMessage)
-			// Ignore every message except BEP10 extension messages
+			// Ignore keep-alives and every message except BEP10 extension messages
 			// TODO: handle other types of messages, if only for statistical purposes
-			if newMessage[0] != msgExtension {
+			if len(newMessage) == 0 || newMessage[0] != msgExtension {
 				continue
 			}
+			if len(newMessage) < 2 {
+				err = newError(ErrInvalidMessage, nil, "Received an empty extension message")
+				return
+			}
 
 			// Check if this is the handshake message for the extension protocol
 			if newMessage[1] == 0 {
@@ -142,6 +231,9 @@ func DownloadMetadataFromPeer(remotePeer, infoHash string) (downloadedTorrent []
 				log.V(3).Infof("WINSTON (peer %s): Received extensions handshake from %s. Parsing...\n", ourPeerID, remotePeer)
 
 				theirExtensionHandshake, err = parseAndValidateExtensionHandshake(newMessage[2:])
+				if err == nil {
+					err = validateMetadataSize(theirExtensionHandshake.MetadataSize, a.options.maxMetadataSize())
+				}
 				if err != nil {
 					log.V(2).Infof("WINSTON (peer %s): Could not parse extensions handshake from %s (%s)\n", ourPeerID, remotePeer, err)
 					return
@@ -149,55 +241,110 @@ func DownloadMetadataFromPeer(remotePeer, infoHash string) (downloadedTorrent []
 				receivedHandshakeInfo = true
 				log.V(2).Infof("WINSTON (peer %s): Parsed extension message from %s: %+v\n", ourPeerID, remotePeer, theirExtensionHandshake)
 
-				// Prepare for receiving the metadata
-				expectedMetadataPiece = 0
-				totalPieces = int(theirExtensionHandshake.MetadataSize / (16 * 1024))
-				receivedMetadata = make([]byte, theirExtensionHandshake.MetadataSize)
+				maxOutstandingRequests = int(theirExtensionHandshake.Reqq)
+				if maxOutstandingRequests == 0 {
+					maxOutstandingRequests = defaultMaxOutstandingRequests
+				}
 
-				// Request the first metadata piece
-				writeChan <- getMetadataRequestPieceMsg(expectedMetadataPiece, theirExtensionHandshake.M["ut_metadata"])
+				// Request the first batch of metadata pieces
+				requestMorePieces()
+				continue
+			} else if newMessage[1] == winstonExtensionUtPex {
+				added, dropped, pexErr := parsePexMessage(newMessage[2:])
+				if pexErr != nil {
+					// Not fatal, the peer may still have the metadata
+					log.V(2).Infof("WINSTON (peer %s): Invalid PEX message from %s: %s\n", ourPeerID, remotePeer, pexErr)
+					continue
+				}
+				log.V(3).Infof("WINSTON (peer %s): Peer %s sent us %d new and %d dropped peers for %x\n", ourPeerID, remotePeer, len(added), len(dropped), infoHash)
+				if len(added) > 0 {
+					a.addDiscoveredPeers(added)
+				}
 				continue
 			} else if newMessage[1] != winstonExtensionUtMetadata {
 				log.V(2).Infof("WINSTON (peer %s): Received unsupported extension message from %s: %q\n", ourPeerID, remotePeer, newMessage)
+				err = newError(ErrInvalidMessage, nil, fmt.Sprintf("Received unsupported extension message %d", newMessage[1]))
 				return
 			}
 
 			if !receivedHandshakeInfo {
 				log.V(2).Infof("WINSTON (peer %s): Peer %s tried to send ut_metadata message before handshake...\n", ourPeerID, remotePeer)
+				err = newError(ErrInvalidMessage, nil, "Received ut_metadata message before the extension handshake")
 				return
 			}
 
-			err := receiveMetadataPiece(expectedMetadataPiece, receivedMetadata, newMessage[2:])
+			var message metadataMessage
+			var pieceData []byte
+			message, pieceData, err = parseMetadataMessage(newMessage[2:])
+			if err == nil && message.MsgType == extMessageMetadataRequest {
+				// The peer wants metadata from us, which we only have if another peer already sent it
+				log.V(3).Infof("WINSTON (peer %s): Peer %s requested metadata piece %d from us\n", ourPeerID, remotePeer, message.Piece)
+				writeChan <- getMetadataResponseMsg(int(message.Piece), a.Metadata(), theirExtensionHandshake.M["ut_metadata"])
+				continue
+			}
+
+			var piece int
+			if err == nil {
+				piece, err = receiveMetadataPiece(theirExtensionHandshake.MetadataSize, message, pieceData)
+			}
+			if err == nil && !outstandingPieces[piece] {
+				err = newError(ErrInvalidMessage, nil, fmt.Sprintf("Received piece %d which was not requested", piece))
+			}
 			if err != nil {
-				log.V(2).Infof("WINSTON (peer %s): Error receiving metadata piece %d of %d: %s\n", ourPeerID, expectedMetadataPiece+1, totalPieces+1, err)
+				log.V(2).Infof("WINSTON (peer %s): Error receiving metadata piece from %s: %s\n", ourPeerID, remotePeer, err)
 				return
 			}
-			log.V(2).Infof("WINSTON (peer %s): Successfully received piece %d of %d for %x from %s!\n", ourPeerID, expectedMetadataPiece+1, totalPieces+1, infoHash, remotePeer)
-
-			if expectedMetadataPiece == totalPieces {
-				sha := sha1.New()
-				sha.Write(receivedMetadata)
-				actualHash := string(sha.Sum(nil))
-				if actualHash != infoHash {
-					log.V(2).Infof("WINSTON (peer %s): Received invalid metadata from %s: received %x, expected %x\n", ourPeerID, remotePeer, actualHash, infoHash)
-				} else {
-					log.V(1).Infof("WINSTON (peer %s): SUCCESSFULLY DOWNLOADED %x from %s\n", ourPeerID, infoHash, remotePeer)
-					downloadedTorrent = receivedMetadata
-				}
+			delete(outstandingPieces, piece)
+			log.V(2).Infof("WINSTON (peer %s): Successfully received piece %d for %x from %s!\n", ourPeerID, piece, infoHash, remotePeer)
+
+			err = a.addPiece(remotePeer, theirExtensionHandshake.MetadataSize, piece, pieceData)
+			if err != nil {
+				log.V(2).Infof("WINSTON (peer %s): Received invalid metadata from %s: %s\n", ourPeerID, remotePeer, err)
 				return
 			}
 
-			// Request the next metadata piece
-			expectedMetadataPiece++
-			writeChan <- getMetadataRequestPieceMsg(expectedMetadataPiece, theirExtensionHandshake.M["ut_metadata"])
+			// Keep the request pipeline full
+			requestMorePieces()
+
+		case <-a.Done():
+			log.V(1).Infof("WINSTON (peer %s): SUCCESSFULLY DOWNLOADED %x, disconnecting from %s\n", ourPeerID, infoHash, remotePeer)
+			downloadedTorrent = a.Metadata()
+			return
+
+		case <-changes:
+			// Some pieces were released by other peers or the assembled metadata was bad
+			changes = a.changes()
+			if a.IsBlacklisted(remotePeer) {
+				err = newError(ErrMetadataHashMismatch, nil, "Peer was blacklisted for sending bad metadata")
+				return
+			}
+			if receivedHandshakeInfo {
+				requestMorePieces()
+			}
 
 		case readErr := <-readErrors:
 			log.V(2).Infof("WINSTON (peer %s): Read error: %s\n", ourPeerID, readErr)
+			err = connectionError(readErr)
 			return
 
 		case writeErr := <-writeErrors:
 			log.V(2).Infof("WINSTON (peer %s): Write error: %s\n", ourPeerID, writeErr)
+			err = connectionError(writeErr)
+			return
+
+		case <-ctx.Done():
+			log.V(2).Infof("WINSTON (peer %s): Download from %s was aborted: %s\n", ourPeerID, remotePeer, ctx.Err())
+			err = newError(ErrAborted, ctx.Err(), fmt.Sprintf("Download was aborted (%s)", ctx.Err()))
 			return
 		}
 	}
 }
+
+// The reader and writer goroutines close their error channels when they exit,
+// so a nil error from them simply means that the connection is gone
+func connectionError(err error) error {
+	if err == nil {
+		return newError(ErrConnectionLost, nil, "Connection was closed")
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The extension number that the fake peers use for ut_metadata
+const fakePeerUtMetadata = 3
+
+// Returns random metadata with the specified number of pieces and its infohash
+func makeTestMetadata(pieces int) (metadata []byte, infoHash string) {
+	metadata = make([]byte, (pieces-1)*metadataPieceSize+metadataPieceSize/2)
+	rand.New(rand.NewSource(int64(pieces))).Read(metadata)
+	sum := sha1.Sum(metadata)
+	return metadata, string(sum[:])
+}
+
+// The remote side of a peer connection in the tests
+type fakePeer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (p *fakePeer) send(msg []byte) error {
+	if err := netWriteUint32(p.conn, uint32(len(msg))); err != nil {
+		return err
+	}
+	_, err := p.conn.Write(msg)
+	return err
+}
+
+// Returns the next extension message, other messages are skipped
+func (p *fakePeer) receiveExtension() (id byte, payload []byte, err error) {
+	for {
+		var n uint32
+		if n, err = netReadUint32(p.conn); err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(p.conn, msg); err != nil {
+			return
+		}
+		if n >= 2 && msg[0] == msgExtension {
+			return msg[1], msg[2:], nil
+		}
+	}
+}
+
+func (p *fakePeer) sendExtensionHandshake(metadataSize, reqq int) error {
+	handshake := map[string]interface{}{
+		"m":             map[string]int{"ut_metadata": fakePeerUtMetadata},
+		"metadata_size": metadataSize,
+	}
+	if reqq > 0 {
+		handshake["reqq"] = reqq
+	}
+	return p.send(getExtensionMsg(0, handshake, nil))
+}
+
+// Receives the extension handshake of the other side and sends ours
+func (p *fakePeer) exchangeExtensionHandshakes(metadataSize, reqq int) {
+	if id, _, err := p.receiveExtension(); err != nil || id != 0 {
+		p.t.Fatalf("Expected an extension handshake, got message %d (%v)", id, err)
+	}
+	if err := p.sendExtensionHandshake(metadataSize, reqq); err != nil {
+		p.t.Fatalf("Could not send the extension handshake: %s", err)
+	}
+}
+
+// Sends the numbers of the requested metadata pieces to the returned channel,
+// until the connection is closed
+func (p *fakePeer) readRequests() <-chan int {
+	requests := make(chan int, 100)
+	go func() {
+		defer close(requests)
+		for {
+			id, payload, err := p.receiveExtension()
+			if err != nil {
+				return
+			}
+			if id != fakePeerUtMetadata {
+				continue
+			}
+			message, _, err := parseMetadataMessage(payload)
+			if err != nil || message.MsgType != extMessageMetadataRequest {
+				p.t.Errorf("Unexpected ut_metadata message %+v (%v)", message, err)
+				return
+			}
+			requests <- int(message.Piece)
+		}
+	}()
+	return requests
+}
+
+func (p *fakePeer) sendPiece(piece int, metadata []byte) error {
+	return p.send(getMetadataResponseMsg(piece, metadata, winstonExtensionUtMetadata))
+}
+
+type sessionResult struct {
+	metadata []byte
+	err      error
+}
+
+// Runs a download session with the assembler over one end of a pipe and returns the other end
+func startDownloadSession(ctx context.Context, t *testing.T, assembler *MetadataAssembler, remotePeer string) (*fakePeer, <-chan sessionResult) {
+	client, server := net.Pipe()
+	results := make(chan sessionResult, 1)
+	go func() {
+		defer client.Close()
+		metadata, err := assembler.downloadSession(ctx, client, "test", remotePeer)
+		results <- sessionResult{metadata, err}
+	}()
+	return &fakePeer{t, server}, results
+}
+
+func receiveRequest(t *testing.T, requests <-chan int) int {
+	select {
+	case piece, ok := <-requests:
+		if !ok {
+			t.Fatalf("The connection was closed while waiting for a request")
+		}
+		return piece
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out while waiting for a request")
+	}
+	return 0
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	tests := []struct {
+		name            string
+		reqq            int
+		pieces          int
+		wantOutstanding int
+	}{
+		{"reqq limit", 4, 10, 4},
+		{"default limit", 0, defaultMaxOutstandingRequests + 4, defaultMaxOutstandingRequests},
+		{"fewer pieces than the limit", 8, 3, 3},
+		{"no pipelining", 1, 3, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			metadata, infoHash := makeTestMetadata(test.pieces)
+			fake, results := startDownloadSession(ctx, t, NewMetadataAssembler(infoHash, nil), "remote")
+			defer fake.conn.Close()
+			fake.exchangeExtensionHandshakes(len(metadata), test.reqq)
+			requests := fake.readRequests()
+
+			// The first batch fills the pipeline and nothing more is requested until it's answered
+			var outstanding []int
+			for len(outstanding) < test.wantOutstanding {
+				outstanding = append(outstanding, receiveRequest(t, requests))
+			}
+			select {
+			case piece := <-requests:
+				t.Fatalf("Piece %d was requested with %d requests outstanding", piece, len(outstanding))
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			// Every answer makes room for exactly one more request
+			requested := len(outstanding)
+			for len(outstanding) > 0 {
+				piece := outstanding[0]
+				outstanding = outstanding[1:]
+				if err := fake.sendPiece(piece, metadata); err != nil {
+					t.Fatalf("Could not send piece %d: %s", piece, err)
+				}
+				if requested < test.pieces {
+					outstanding = append(outstanding, receiveRequest(t, requests))
+					requested++
+				}
+			}
+
+			result := <-results
+			if result.err != nil {
+				t.Fatalf("Unexpected error: %s", result.err)
+			}
+			if !bytes.Equal(result.metadata, metadata) {
+				t.Errorf("Received metadata does not match")
+			}
+		})
+	}
+}
+
+// Starts a peer that accepts one connection, optionally completes the handshakes
+// and then stays silent until the connection is closed. ready is closed once the
+// peer has gone silent.
+func startSilentPeer(t *testing.T, infoHash string, metadataSize int, handshake bool) (address string, ready <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	silent := make(chan struct{})
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if handshake {
+			if _, err := readHeader(conn); err != nil {
+				t.Errorf("Could not read the header: %s", err)
+				return
+			}
+			if _, err := conn.Write(getSessionHeader(infoHash, NewPeerID())); err != nil {
+				t.Errorf("Could not send the header: %s", err)
+				return
+			}
+			fake := &fakePeer{t, conn}
+			if id, _, err := fake.receiveExtension(); err != nil || id != 0 {
+				t.Errorf("Expected an extension handshake, got message %d (%v)", id, err)
+				return
+			}
+			if err := fake.sendExtensionHandshake(metadataSize, 0); err != nil {
+				t.Errorf("Could not send the extension handshake: %s", err)
+				return
+			}
+		}
+		close(silent)
+		io.Copy(io.Discard, conn)
+	}()
+	return ln.Addr().String(), silent
+}
+
+func TestDownloadFromSilentPeerIsAborted(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake bool
+	}{
+		{"during the handshake", false},
+		{"while waiting for pieces", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, infoHash := makeTestMetadata(2)
+			options := DefaultOptions
+			options.Encryption = EncryptionDisabled
+			options.HandshakeTimeout = time.Minute
+			options.ReadTimeout = time.Minute
+
+			goroutines := runtime.NumGoroutine()
+			address, silent := startSilentPeer(t, infoHash, len(metadata), test.handshake)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			results := make(chan error, 1)
+			go func() {
+				_, err := NewMetadataAssembler(infoHash, &options).DownloadFromPeer(ctx, address)
+				results <- err
+			}()
+
+			select {
+			case <-silent:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("The peer was not contacted")
+			}
+			cancel()
+			select {
+			case err := <-results:
+				if !errors.Is(err, ErrAborted) {
+					t.Errorf("Expected ErrAborted, got %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("The download did not return after it was cancelled")
+			}
+
+			// The reader and writer goroutines exit with the session, and the
+			// peer's goroutine once the connection is closed
+			for start := time.Now(); runtime.NumGoroutine() > goroutines; {
+				if time.Since(start) > 2*time.Second {
+					t.Fatalf("%d goroutines are still running, expected %d", runtime.NumGoroutine(), goroutines)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Flags for the peers in ut_pex messages (BEP11)
+const (
+	PexPrefersEncryption = 0x01
+	PexSeed              = 0x02
+	PexSupportsUTP       = 0x04
+	PexSupportsHolepunch = 0x08
+	PexConnectable       = 0x10
+)
+
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// PexPeer is a peer that was received through Peer Exchange
+type PexPeer struct {
+	Address string // In the host:port format
+	Flags   byte
+}
+
+// DecodeCompactPeers parses a list of peers in the compact format, where every peer
+// is represented by its IP address (4 bytes for IPv4, 16 bytes for IPv6) followed by
+// a 2-byte port number. The returned addresses are in the host:port format.
+func DecodeCompactPeers(data []byte, ipv6 bool) (peers []string, err error) {
+	ipLength := net.IPv4len
+	if ipv6 {
+		ipLength = net.IPv6len
+	}
+	peerLength := ipLength + 2
+
+	if len(data)%peerLength != 0 {
+		err = fmt.Errorf("Invalid length %d of compact peer list", len(data))
+		return
+	}
+
+	for i := 0; i < len(data); i += peerLength {
+		ip := net.IP(data[i : i+ipLength])
+		port := binary.BigEndian.Uint16(data[i+ipLength : i+peerLength])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return
+}
+
+func decodePexPeers(compact, flags string, ipv6 bool) (peers []PexPeer, err error) {
+	addresses, err := DecodeCompactPeers([]byte(compact), ipv6)
+	if err != nil {
+		return
+	}
+
+	for i, address := range addresses {
+		peer := PexPeer{Address: address}
+		// The flags are optional, but if they are present there should be one for each peer
+		if len(flags) == len(addresses) {
+			peer.Flags = flags[i]
+		}
+		peers = append(peers, peer)
+	}
+	return
+}
+
+// Parses a ut_pex message and returns the added and dropped peers
+func parsePexMessage(msg []byte) (added []PexPeer, dropped []string, err error) {
+	var message pexMessage
+	err = bencode.Unmarshal(bytes.NewReader(msg), &message)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Error when parsing PEX message (%s)", err))
+		return
+	}
+
+	added4, err := decodePexPeers(message.Added, message.AddedF, false)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Invalid PEX added list (%s)", err))
+		return
+	}
+	added6, err := decodePexPeers(message.Added6, message.Added6F, true)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Invalid PEX added6 list (%s)", err))
+		return
+	}
+	added = append(added4, added6...)
+
+	dropped4, err := DecodeCompactPeers([]byte(message.Dropped), false)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Invalid PEX dropped list (%s)", err))
+		return
+	}
+	dropped6, err := DecodeCompactPeers([]byte(message.Dropped6), true)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Invalid PEX dropped6 list (%s)", err))
+		return
+	}
+	dropped = append(dropped4, dropped6...)
+
+	return
+}
@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestDecodeCompactPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		ipv6    bool
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", false, nil, false},
+		{"ipv4", "\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50", false, []string{"10.0.0.1:6881", "192.168.1.2:80"}, false},
+		{"ipv6", "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5", true, []string{"[2001:db8::1]:51413"}, false},
+		{"ipv4-mapped ipv6", "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01\x1a\xe1", true, []string{"10.0.0.1:6881"}, false},
+		{"truncated ipv4", "\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01", false, nil, true},
+		{"ipv4 as ipv6", "\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50", true, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers, err := DecodeCompactPeers([]byte(test.data), test.ipv6)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(peers, test.want) {
+				t.Errorf("Expected peers %v, got %v", test.want, peers)
+			}
+		})
+	}
+}
+
+func TestParsePexMessage(t *testing.T) {
+	const (
+		peer1 = "\x0a\x00\x00\x01\x1a\xe1"
+		peer2 = "\xc0\xa8\x01\x02\x00\x50"
+		peer6 = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5"
+	)
+
+	tests := []struct {
+		name        string
+		message     pexMessage
+		wantAdded   []PexPeer
+		wantDropped []string
+		wantErr     bool
+	}{
+		{
+			name:        "empty",
+			message:     pexMessage{},
+			wantAdded:   nil,
+			wantDropped: nil,
+		},
+		{
+			name:        "with flags",
+			message:     pexMessage{Added: peer1 + peer2, AddedF: string([]byte{PexSeed | PexSupportsUTP, PexConnectable})},
+			wantAdded:   []PexPeer{{"10.0.0.1:6881", PexSeed | PexSupportsUTP}, {"192.168.1.2:80", PexConnectable}},
+			wantDropped: nil,
+		},
+		{
+			// The flags are ignored if they don't match the peers
+			name:        "wrong number of flags",
+			message:     pexMessage{Added: peer1 + peer2, AddedF: string([]byte{PexSeed})},
+			wantAdded:   []PexPeer{{"10.0.0.1:6881", 0}, {"192.168.1.2:80", 0}},
+			wantDropped: nil,
+		},
+		{
+			name:        "ipv4 and ipv6",
+			message:     pexMessage{Added: peer1, Added6: peer6, Added6F: string([]byte{PexSeed}), Dropped: peer2, Dropped6: peer6},
+			wantAdded:   []PexPeer{{"10.0.0.1:6881", 0}, {"[2001:db8::1]:51413", PexSeed}},
+			wantDropped: []string{"192.168.1.2:80", "[2001:db8::1]:51413"},
+		},
+		{name: "truncated added", message: pexMessage{Added: peer1 + peer2[:4]}, wantErr: true},
+		{name: "truncated added6", message: pexMessage{Added6: peer6[:10]}, wantErr: true},
+		{name: "truncated dropped", message: pexMessage{Dropped: peer1[:5]}, wantErr: true},
+		{name: "truncated dropped6", message: pexMessage{Dropped6: peer6 + peer1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var msg bytes.Buffer
+			if err := bencode.Marshal(&msg, test.message); err != nil {
+				t.Fatalf("Could not encode the message: %s", err)
+			}
+
+			added, dropped, err := parsePexMessage(msg.Bytes())
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidMessage) {
+					t.Errorf("Expected ErrInvalidMessage, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(added, test.wantAdded) {
+				t.Errorf("Expected added peers %v, got %v", test.wantAdded, added)
+			}
+			if !reflect.DeepEqual(dropped, test.wantDropped) {
+				t.Errorf("Expected dropped peers %v, got %v", test.wantDropped, dropped)
+			}
+		})
+	}
+
+	if _, _, err := parsePexMessage([]byte("d5:added")); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage for an invalid message, got %v", err)
+	}
+}
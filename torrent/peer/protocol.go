@@ -6,16 +6,19 @@ package peer
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
-	"time"
 
 	"github.com/jackpal/bencode-go"
 
+	"github.com/na--/winston/torrent/mse"
+
 	log "github.com/golang/glog"
 )
 
@@ -30,7 +33,8 @@ type extensionHandshake struct {
 	MetadataSize uint           `bencode:"metadata_size"`
 }
 
-func getNewPeerID() string {
+// NewPeerID returns a new random 20-byte peer ID
+func NewPeerID() string {
 	sid := "-md" + strconv.Itoa(os.Getpid()) + "_" + strconv.FormatInt(rand.Int63(), 10)
 	return sid[0:20]
 }
@@ -48,14 +52,20 @@ func getSessionHeader(infoHash string, peerID string) []byte {
 	return header
 }
 
-func getExtensionsHandshakeMsg() []byte {
+// If we have the metadata for the torrent, metadataSize should be its size,
+// so other peers know they can request it from us
+func getExtensionsHandshakeMsg(metadataSize int) []byte {
 	//TODO: add port and other extensions
 	handshake := map[string]interface{}{
 		"m": map[string]int{
 			"ut_metadata": winstonExtensionUtMetadata,
+			"ut_pex":      winstonExtensionUtPex,
 		},
 		"v": "Winston 0.1",
 	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
 
 	var buf bytes.Buffer
 	err := bencode.Marshal(&buf, handshake)
@@ -72,39 +82,65 @@ func getExtensionsHandshakeMsg() []byte {
 }
 
 func getMetadataRequestPieceMsg(pieceNumber, theirMetadataExtensionNumber int) []byte {
-	m := map[string]int{
+	return getExtensionMsg(theirMetadataExtensionNumber, map[string]int{
 		"msg_type": extMessageMetadataRequest,
 		"piece":    pieceNumber,
-	}
+	}, nil)
+}
 
+func getExtensionMsg(theirExtensionNumber int, m interface{}, trailer []byte) []byte {
 	var raw bytes.Buffer
 	err := bencode.Marshal(&raw, m)
 	if err != nil {
 		panic("Can't you marshal a simple message, what's wrong with you?!?!")
 	}
 
-	msg := make([]byte, raw.Len()+2)
+	msg := make([]byte, raw.Len()+len(trailer)+2)
 	msg[0] = msgExtension
-	msg[1] = byte(theirMetadataExtensionNumber)
+	msg[1] = byte(theirExtensionNumber)
 	copy(msg[2:], raw.Bytes())
+	copy(msg[2+raw.Len():], trailer)
 
 	return msg
 }
 
+// Returns the answer to a metadata request: a data message with the requested
+// piece or a reject message if we don't have the metadata or the piece is invalid
+func getMetadataResponseMsg(pieceNumber int, metadata []byte, theirMetadataExtensionNumber int) []byte {
+	if metadata == nil || pieceNumber < 0 || pieceNumber >= metadataPieceCount(uint(len(metadata))) {
+		return getExtensionMsg(theirMetadataExtensionNumber, map[string]int{
+			"msg_type": extMessageMetadataReject,
+			"piece":    pieceNumber,
+		}, nil)
+	}
+
+	pieceStartPos := pieceNumber * metadataPieceSize
+	pieceEndPos := pieceStartPos + metadataPieceSize
+	if pieceEndPos > len(metadata) {
+		pieceEndPos = len(metadata)
+	}
+
+	return getExtensionMsg(theirMetadataExtensionNumber, map[string]int{
+		"msg_type":   extMessageMetadataData,
+		"piece":      pieceNumber,
+		"total_size": len(metadata),
+	}, metadata[pieceStartPos:pieceEndPos])
+}
+
 func readHeader(conn net.Conn) (h []byte, err error) {
 	header := make([]byte, 68)
-	_, err = conn.Read(header[0:1])
+	_, err = io.ReadFull(conn, header[0:1])
 	if err != nil {
-		err = fmt.Errorf("Couldn't read 1st byte: %v", err)
+		err = fmt.Errorf("Couldn't read 1st byte: %w", err)
 		return
 	}
 	if header[0] != 19 {
 		err = fmt.Errorf("First byte is not 19")
 		return
 	}
-	_, err = conn.Read(header[1:20])
+	_, err = io.ReadFull(conn, header[1:20])
 	if err != nil {
-		err = fmt.Errorf("Couldn't read magic string: %v", err)
+		err = fmt.Errorf("Couldn't read magic string: %w", err)
 		return
 	}
 	if string(header[1:20]) != "BitTorrent protocol" {
@@ -112,9 +148,9 @@ func readHeader(conn net.Conn) (h []byte, err error) {
 		return
 	}
 	// Read rest of header
-	_, err = conn.Read(header[20:])
+	_, err = io.ReadFull(conn, header[20:])
 	if err != nil {
-		err = fmt.Errorf("Couldn't read rest of header")
+		err = fmt.Errorf("Couldn't read rest of header: %w", err)
 		return
 	}
 
@@ -123,28 +159,73 @@ func readHeader(conn net.Conn) (h []byte, err error) {
 	return
 }
 
-func initiateConnectionToPeer(remotePeer, ourPeerID, wantedInfoHash string) (conn net.Conn, theirFlags []byte, theirInfoHash, theirPeerID string, err error) {
+// Closes the connection as soon as the context is done, which unblocks any pending
+// reads and writes. The caller has to cancel ctx once it no longer needs conn,
+// otherwise the goroutine will leak.
+func closeOnDone(ctx context.Context, conn net.Conn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+}
+
+// The caller has to cancel ctx once the connection is no longer needed (see closeOnDone)
+func initiateConnectionToPeer(ctx context.Context, remotePeer, ourPeerID, wantedInfoHash string, options *Options) (conn net.Conn, theirFlags []byte, theirInfoHash, theirPeerID string, err error) {
+	conn, theirFlags, theirInfoHash, theirPeerID, err = initiateHandshake(ctx, options, options.Encryption, remotePeer, ourPeerID, wantedInfoHash)
+
+	// The peer might not support encryption, so try again with a plaintext connection
+	if err != nil && options.Encryption == EncryptionPreferred && errors.Is(err, ErrEncryptionFailed) {
+		log.V(3).Infof("WINSTON (peer %s): Encrypted connection to %s failed, trying plaintext (%s)\n", ourPeerID, remotePeer, err)
+		return initiateHandshake(ctx, options, EncryptionDisabled, remotePeer, ourPeerID, wantedInfoHash)
+	}
+	return
+}
+
+func initiateHandshake(ctx context.Context, options *Options, encryption EncryptionPolicy, remotePeer, ourPeerID, wantedInfoHash string) (conn net.Conn, theirFlags []byte, theirInfoHash, theirPeerID string, err error) {
 	ourSessionHader := getSessionHeader(wantedInfoHash, ourPeerID)
 
-	conn, err = net.DialTimeout("tcp", remotePeer, 5*time.Second)
+	dialCtx, cancelDial := ctx, context.CancelFunc(func() {})
+	if options.DialTimeout > 0 {
+		dialCtx, cancelDial = context.WithTimeout(ctx, options.DialTimeout)
+	}
+	conn, err = options.dialer().DialContext(dialCtx, "tcp", remotePeer)
+	cancelDial()
 	if err != nil {
-		err = fmt.Errorf("Could not connect (%s)", err)
+		err = newError(ErrConnectionFailed, err, fmt.Sprintf("Could not connect (%s)", err))
 		return
 	}
+	closeOnDone(ctx, conn)
 	log.V(3).Infof("WINSTON (peer %s): Connected to peer %s!\n", ourPeerID, remotePeer)
 
-	// We want the connection operations to finish in the next 20 seconds
-	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	// We want the handshakes to finish in time
+	conn.SetDeadline(deadline(options.HandshakeTimeout))
+
+	if encryption != EncryptionDisabled {
+		provide := mse.CryptoRC4
+		if encryption == EncryptionPreferred {
+			provide |= mse.CryptoPlaintext
+		}
+
+		var encryptedConn *mse.Conn
+		encryptedConn, err = mse.Initiate(conn, string2Bytes(wantedInfoHash), provide)
+		if err != nil {
+			conn.Close()
+			err = newError(ErrEncryptionFailed, err, fmt.Sprintf("Encrypted handshake failed (%s)", err))
+			return
+		}
+		log.V(3).Infof("WINSTON (peer %s): Established encrypted connection with %s (method %d)\n", ourPeerID, remotePeer, encryptedConn.Method())
+		conn = encryptedConn
+	}
 
 	_, err = conn.Write(ourSessionHader)
 	if err != nil {
-		err = fmt.Errorf("Failed to send header (%s)", err)
+		err = newError(ErrHandshakeFailed, err, fmt.Sprintf("Failed to send header (%s)", err))
 		return
 	}
 
 	theirHeader, err := readHeader(conn)
 	if err != nil {
-		err = fmt.Errorf("Error reading header (%s)", err)
+		err = newError(ErrHandshakeFailed, err, fmt.Sprintf("Error reading header (%s)", err))
 		return
 	}
 
@@ -153,12 +234,92 @@ func initiateConnectionToPeer(remotePeer, ourPeerID, wantedInfoHash string) (con
 	theirPeerID = string(theirHeader[28:48])
 
 	if theirInfoHash != wantedInfoHash {
-		err = fmt.Errorf("Remote infohash is %x", theirInfoHash)
+		err = newError(ErrWrongInfoHash, nil, fmt.Sprintf("Remote infohash is %x", theirInfoHash))
+		return
+	}
+
+	if int(theirFlags[5])&0x10 != 0x10 {
+		err = newError(ErrNoExtensionProtocol, nil, fmt.Sprintf("Remote torrent client does not support the extension protocol; flags are %x", theirFlags))
+		return
+	}
+
+	return
+}
+
+// Handles the BitTorrent handshake for a connection that a remote peer initiated and
+// returns the connection that should be used afterwards, since it may be encrypted.
+// We reply with our own header only if isKnown returns true for the infohash they want.
+// Encrypted connections don't send the infohash in plaintext, so we can accept
+// them only for the infohashes returned by knownInfoHashes.
+func acceptConnectionFromPeer(rawConn net.Conn, ourPeerID string, isKnown func(infoHash string) bool, knownInfoHashes func() []string, options *Options) (conn net.Conn, theirFlags []byte, theirInfoHash, theirPeerID string, err error) {
+	// We want the handshakes to finish in time
+	rawConn.SetDeadline(deadline(options.HandshakeTimeout))
+	encryption := options.Encryption
+
+	// Plaintext connections start with the BitTorrent header, everything else is
+	// treated as the start of an encrypted handshake
+	bufConn := &bufferedConn{rawConn, bufio.NewReader(rawConn)}
+	conn = bufConn
+	firstByte, err := bufConn.r.Peek(1)
+	if err != nil {
+		err = newError(ErrHandshakeFailed, err, fmt.Sprintf("Error reading header (%s)", err))
+		return
+	}
+
+	if firstByte[0] == bitTorrentHeader[0] {
+		if encryption == EncryptionRequired {
+			err = newError(ErrEncryptionFailed, nil, "Remote peer tried to use a plaintext connection")
+			return
+		}
+	} else {
+		if encryption == EncryptionDisabled {
+			err = newError(ErrEncryptionFailed, nil, "Remote peer tried to use an encrypted connection")
+			return
+		}
+
+		allowed := mse.CryptoRC4
+		if encryption == EncryptionPreferred {
+			allowed |= mse.CryptoPlaintext
+		}
+		lookup := func(skeyHash []byte) []byte {
+			for _, infoHash := range knownInfoHashes() {
+				if bytes.Equal(mse.HashSKey(string2Bytes(infoHash)), skeyHash) {
+					return string2Bytes(infoHash)
+				}
+			}
+			return nil
+		}
+
+		conn, _, err = mse.Receive(bufConn, lookup, allowed)
+		if err != nil {
+			err = newError(ErrEncryptionFailed, err, fmt.Sprintf("Encrypted handshake failed (%s)", err))
+			return
+		}
+	}
+
+	theirHeader, err := readHeader(conn)
+	if err != nil {
+		err = newError(ErrHandshakeFailed, err, fmt.Sprintf("Error reading header (%s)", err))
+		return
+	}
+
+	theirFlags = theirHeader[0:8]
+	theirInfoHash = string(theirHeader[8:28])
+	theirPeerID = string(theirHeader[28:48])
+
+	if !isKnown(theirInfoHash) {
+		err = newError(ErrWrongInfoHash, nil, fmt.Sprintf("Remote peer wants unknown infohash %x", theirInfoHash))
 		return
 	}
 
 	if int(theirFlags[5])&0x10 != 0x10 {
-		err = fmt.Errorf("Remote torrent client does not support the extension protocol; flags are %x", theirFlags)
+		err = newError(ErrNoExtensionProtocol, nil, fmt.Sprintf("Remote torrent client does not support the extension protocol; flags are %x", theirFlags))
+		return
+	}
+
+	_, err = conn.Write(getSessionHeader(theirInfoHash, ourPeerID))
+	if err != nil {
+		err = newError(ErrHandshakeFailed, err, fmt.Sprintf("Failed to send header (%s)", err))
 		return
 	}
 
@@ -169,20 +330,24 @@ func parseAndValidateExtensionHandshake(msg []byte) (result extensionHandshake,
 
 	err = bencode.Unmarshal(bytes.NewReader(msg), &result)
 	if err != nil {
-		err = fmt.Errorf("Error when unmarshaling extension handshake (%s)", err)
+		err = newError(ErrInvalidExtensionHandshake, err, fmt.Sprintf("Error when unmarshaling extension handshake (%s)", err))
 		return
 	}
 
 	if _, ok := result.M["ut_metadata"]; !ok {
-		err = fmt.Errorf("Metadata extension is not supported; only supported %v", result.M)
+		err = newError(ErrNoMetadataExtension, nil, fmt.Sprintf("Metadata extension is not supported; only supported %v", result.M))
 		return
 	}
 
-	if result.MetadataSize <= 0 || result.MetadataSize > 2*1024*1024 {
-		err = fmt.Errorf("Invalid metadata size %d", result.MetadataSize)
-		return
-	}
+	return
+}
 
+// Peers that want to download metadata from us don't have to specify its size,
+// so this is checked separately from the rest of the extension handshake
+func validateMetadataSize(metadataSize uint, maxSize int) (err error) {
+	if metadataSize <= 0 || metadataSize > uint(maxSize) {
+		err = newError(ErrInvalidMetadataSize, nil, fmt.Sprintf("Invalid metadata size %d", metadataSize))
+	}
 	return
 }
 
@@ -192,57 +357,65 @@ type metadataMessage struct {
 	TotalSize uint  `bencode:"total_size"`
 }
 
-func receiveMetadataPiece(expectedMetadataPiece int, receivedMetadata, msg []byte) (err error) {
+// Parses a ut_metadata message and returns the raw data after the bencoded dictionary
+func parseMetadataMessage(msg []byte) (message metadataMessage, payload []byte, err error) {
 	// We need a buffered reader because the raw data is put directly
 	// after the bencoded data, and a simple reader will get all its bytes
 	// eaten. A buffered reader will keep a reference to where the
 	// bdecoding ended.
 	br := bufio.NewReader(bytes.NewReader(msg))
-	var message metadataMessage
 
 	err = bencode.Unmarshal(br, &message)
 	if err != nil {
-		err = fmt.Errorf("Error when parsing metadata (%s)", err)
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Error when parsing metadata (%s)", err))
+		return
+	}
+
+	//TODO: optimize, this seems wasteful
+	var rest bytes.Buffer
+	_, err = io.Copy(&rest, br)
+	if err != nil {
+		err = newError(ErrInvalidMessage, err, fmt.Sprintf("Could not copy metadata piece (%s)", err))
 		return
 	}
+	payload = rest.Bytes()
 
+	return
+}
+
+// Validates a parsed ut_metadata data message for metadata with the specified size.
+// Pieces can be received in any order, the caller is responsible for checking if the
+// returned piece was actually requested. Metadata requests should be handled by the
+// caller before this is called.
+func receiveMetadataPiece(metadataSize uint, message metadataMessage, pieceData []byte) (pieceNumber int, err error) {
 	if message.MsgType != extMessageMetadataData {
 		if message.MsgType == extMessageMetadataRequest {
-			err = fmt.Errorf("The remote peer tried to request metadata, this is not yet supported")
+			err = newError(ErrInvalidMessage, nil, "Unexpected metadata request from the remote peer")
 		} else if message.MsgType == extMessageMetadataReject {
-			err = fmt.Errorf("The remote peer rejected our request for metadata... meanie :(")
+			err = newError(ErrMetadataRejected, nil, "The remote peer rejected our request for metadata... meanie :(")
 		} else {
-			err = fmt.Errorf("Unknown extension message type %q", message.MsgType)
+			err = newError(ErrInvalidMessage, nil, fmt.Sprintf("Unknown extension message type %q", message.MsgType))
 		}
 
 		return
 	}
 
-	if expectedMetadataPiece != int(message.Piece) {
-		err = fmt.Errorf("Expected piece %d and received piece %d", expectedMetadataPiece, message.Piece)
+	pieceNumber = int(message.Piece)
+	if pieceNumber >= metadataPieceCount(metadataSize) {
+		err = newError(ErrInvalidMessage, nil, fmt.Sprintf("Received piece %d, but the metadata has only %d pieces", pieceNumber, metadataPieceCount(metadataSize)))
 		return
 	}
 
-	//TODO: optimize, this seems wasteful
-	var piece bytes.Buffer
-	_, err = io.Copy(&piece, br)
-	if err != nil {
-		err = fmt.Errorf("Could not copy metadata piece (%s)", err)
-		return
-	}
+	pieceStartPos := metadataPieceSize * pieceNumber
+	pieceSize := len(pieceData)
 
-	const defaultPieceSize = 16384
-	pieceStartPos := defaultPieceSize * int(message.Piece)
-	pieceSize := piece.Len()
-
-	if pieceSize > defaultPieceSize || (pieceSize != 16384 && pieceStartPos+pieceSize != len(receivedMetadata)) {
-		err = fmt.Errorf("Invalid piece size %d for piece %d", pieceSize, message.Piece)
+	if pieceSize > metadataPieceSize || pieceStartPos+pieceSize > int(metadataSize) ||
+		(pieceSize != metadataPieceSize && pieceStartPos+pieceSize != int(metadataSize)) {
+		err = newError(ErrInvalidMessage, nil, fmt.Sprintf("Invalid piece size %d for piece %d", pieceSize, message.Piece))
 		return
 	}
 
 	log.V(2).Infof("WINSTON: Received metadata piece #%d with size %d!\n", message.Piece, pieceSize)
 
-	copy(receivedMetadata[pieceStartPos:pieceStartPos+pieceSize], piece.Bytes())
-
 	return
 }
@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A MetadataStore with the metadata of a few torrents
+type testStore map[string][]byte
+
+func (s testStore) GetMetadata(infoHash string) []byte {
+	return s[infoHash]
+}
+
+func (s testStore) InfoHashes() (infoHashes []string) {
+	for infoHash := range s {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return
+}
+
+// Counts the connections made through TCPDialer
+type countingDialer struct {
+	dials int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return TCPDialer.DialContext(ctx, network, address)
+}
+
+func TestEncryptionPolicies(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(2)
+	store := testStore{infoHash: metadata}
+
+	tests := []struct {
+		client, listener EncryptionPolicy
+		wantErr          error // nil if the download should succeed
+		wantDials        int32 // Two if the client falls back to plaintext
+	}{
+		{EncryptionDisabled, EncryptionDisabled, nil, 1},
+		{EncryptionDisabled, EncryptionPreferred, nil, 1},
+		{EncryptionDisabled, EncryptionRequired, ErrHandshakeFailed, 1},
+		{EncryptionPreferred, EncryptionDisabled, nil, 2},
+		{EncryptionPreferred, EncryptionPreferred, nil, 1},
+		{EncryptionPreferred, EncryptionRequired, nil, 1},
+		{EncryptionRequired, EncryptionDisabled, ErrEncryptionFailed, 1},
+		{EncryptionRequired, EncryptionPreferred, nil, 1},
+		{EncryptionRequired, EncryptionRequired, nil, 1},
+	}
+	names := map[EncryptionPolicy]string{
+		EncryptionDisabled:  "disabled",
+		EncryptionPreferred: "prefer",
+		EncryptionRequired:  "require",
+	}
+
+	for _, test := range tests {
+		t.Run(names[test.client]+" to "+names[test.listener], func(t *testing.T) {
+			listenerOptions := DefaultOptions
+			listenerOptions.Encryption = test.listener
+			l := startTestListener(t, store, &listenerOptions)
+
+			dialer := &countingDialer{}
+			clientOptions := DefaultOptions
+			clientOptions.Encryption = test.client
+			clientOptions.Dialer = dialer
+			clientOptions.HandshakeTimeout = 5 * time.Second
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			downloaded, err := NewMetadataAssembler(infoHash, &clientOptions).DownloadFromPeer(ctx, l.Addr().String())
+
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if !bytes.Equal(downloaded, metadata) {
+					t.Errorf("Downloaded metadata does not match")
+				}
+			} else if !errors.Is(err, test.wantErr) {
+				t.Errorf("Expected error %q, got %v", test.wantErr, err)
+			}
+			if dials := atomic.LoadInt32(&dialer.dials); dials != test.wantDials {
+				t.Errorf("Expected %d connections, got %d", test.wantDials, dials)
+			}
+		})
+	}
+}
+
+func TestDownloadMetadataFromPeer(t *testing.T) {
+	metadata, infoHash := makeTestMetadata(3)
+	_, unknownInfoHash := makeTestMetadata(1)
+	l := startTestListener(t, testStore{infoHash: metadata}, nil)
+
+	downloaded, err := DownloadMetadataFromPeer(l.Addr().String(), infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(downloaded, metadata) {
+		t.Errorf("Downloaded metadata does not match")
+	}
+
+	// Encrypted connections for torrents the listener doesn't have fail before the
+	// BitTorrent handshake, and then the plaintext ones fail after it
+	if _, err = DownloadMetadataFromPeer(l.Addr().String(), unknownInfoHash); !errors.Is(err, ErrHandshakeFailed) {
+		t.Errorf("Expected a failed handshake for an unknown torrent, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+)
+
+// MetadataStore is used for looking up the metadata of torrents that we can send to other peers
+type MetadataStore interface {
+	// GetMetadata returns the metadata (the bencoded info dictionary) for the
+	// specified raw infohash or nil if we don't have it
+	GetMetadata(infoHash string) []byte
+}
+
+// InfoHashLister can be implemented by a MetadataStore to allow serving its metadata
+// over encrypted connections, where the requested infohash is not sent in plaintext
+type InfoHashLister interface {
+	// InfoHashes returns the raw infohashes of all the torrents in the store
+	InfoHashes() []string
+}
+
+// ServeMetadata handles a connection that was initiated by a remote peer who wants
+// to download torrent metadata from us. The connection is accepted only if the store
+// has the metadata for the requested infohash. ServeMetadata answers the peer's
+// ut_metadata requests until they disconnect or ctx is cancelled, and it closes conn
+// before returning. If options is nil, DefaultOptions are used.
+func ServeMetadata(ctx context.Context, conn net.Conn, store MetadataStore, options *Options) (err error) {
+	l := &Listener{store: store, options: getOptions(options)}
+	return l.handleConnection(ctx, conn)
+}
+
+// Sends our extension handshake and answers metadata requests on an already
+// established connection
+func serveMetadataSession(ctx context.Context, conn net.Conn, ourPeerID, remotePeer string, metadata []byte, options *Options) (err error) {
+	readChan, readErrors := createPeerReader(conn, ctx.Done(), options)
+	writeChan, writeErrors := createPeerWriter(conn, ctx.Done(), options)
+	defer close(writeChan)
+
+	writeChan <- getExtensionsHandshakeMsg(len(metadata))
+
+	var theirExtensionHandshake extensionHandshake
+	receivedHandshakeInfo := false
+
+	for {
+		select {
+		case newMessage, chanOk := <-readChan:
+			if !chanOk {
+				err = newError(ErrConnectionLost, nil, "Reader channel unexpectedly closed")
+				return
+			}
+
+			// We are only interested in BEP10 extension messages, not even in keep-alives
+			if len(newMessage) < 2 || newMessage[0] != msgExtension {
+				continue
+			}
+
+			if newMessage[1] == 0 {
+				theirExtensionHandshake, err = parseAndValidateExtensionHandshake(newMessage[2:])
+				if err != nil {
+					log.V(2).Infof("WINSTON (peer %s): Could not parse extensions handshake from %s (%s)\n", ourPeerID, remotePeer, err)
+					return
+				}
+				receivedHandshakeInfo = true
+				continue
+			} else if newMessage[1] != winstonExtensionUtMetadata || !receivedHandshakeInfo {
+				continue
+			}
+
+			var message metadataMessage
+			message, _, err = parseMetadataMessage(newMessage[2:])
+			if err != nil {
+				return
+			}
+			if message.MsgType != extMessageMetadataRequest {
+				continue
+			}
+
+			log.V(3).Infof("WINSTON (peer %s): Sending metadata piece %d to %s\n", ourPeerID, message.Piece, remotePeer)
+			writeChan <- getMetadataResponseMsg(int(message.Piece), metadata, theirExtensionHandshake.M["ut_metadata"])
+
+		case readErr := <-readErrors:
+			log.V(3).Infof("WINSTON (peer %s): Read error while serving %s: %s\n", ourPeerID, remotePeer, readErr)
+			err = connectionError(readErr)
+			return
+
+		case writeErr := <-writeErrors:
+			log.V(3).Infof("WINSTON (peer %s): Write error while serving %s: %s\n", ourPeerID, remotePeer, writeErr)
+			err = connectionError(writeErr)
+			return
+
+		case <-ctx.Done():
+			err = newError(ErrAborted, ctx.Err(), fmt.Sprintf("Serving metadata was aborted (%s)", ctx.Err()))
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5NoAcceptable   = 0xff
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5PasswordAuthV1 = 0x01
+)
+
+var socks5ReplyErrors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connects to peers through a SOCKS5 proxy (RFC 1928), optionally
+// authenticating with a username and password (RFC 1929)
+type SOCKS5Dialer struct {
+	ProxyAddress string
+	Username     string // Leave empty if the proxy doesn't require authentication
+	Password     string
+	Forward      Dialer // Used for connecting to the proxy itself, TCPDialer if nil
+}
+
+// DialContext connects to the proxy and asks it to connect to the address
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = TCPDialer
+	}
+
+	conn, err = forward.DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to SOCKS5 proxy %s: %w", d.ProxyAddress, err)
+	}
+
+	// The negotiation with the proxy should also be stopped when the context is
+	// done. The expired deadline only interrupts it, the connection is closed below.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err = d.negotiate(conn, address)
+	if !stop() {
+		// The context was done, even if the negotiation managed to finish
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s could not connect to %s: %w", d.ProxyAddress, address, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) negotiate(conn net.Conn, address string) (err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port '%s'", portStr)
+	}
+
+	// Greeting with the supported authentication methods
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if d.Username != "" {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err = d.authenticate(conn); err != nil {
+			return
+		}
+	case socks5NoAcceptable:
+		return errors.New("No acceptable authentication methods")
+	default:
+		return fmt.Errorf("Unsupported authentication method %d", reply[1])
+	}
+
+	// The connection request
+	request := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name '%s' is too long", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[1] != 0 {
+		if msg, ok := socks5ReplyErrors[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("Unknown SOCKS5 error %d", header[1])
+	}
+
+	// Skip the address that the proxy bound for the connection
+	var boundAddressLength int
+	switch header[3] {
+	case socks5AddrIPv4:
+		boundAddressLength = net.IPv4len
+	case socks5AddrIPv6:
+		boundAddressLength = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		boundAddressLength = int(length[0])
+	default:
+		return fmt.Errorf("Unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundAddressLength+2))
+	return
+}
+
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) (err error) {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("Username or password is too long")
+	}
+
+	request := []byte{socks5PasswordAuthV1, byte(len(d.Username))}
+	request = append(request, d.Username...)
+	request = append(request, byte(len(d.Password)))
+	request = append(request, d.Password...)
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[1] != 0 {
+		return errors.New("Authentication failed")
+	}
+	return
+}
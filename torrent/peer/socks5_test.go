@@ -0,0 +1,199 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A SOCKS5 proxy that accepts a single client and echoes the data after a
+// successful CONNECT instead of connecting anywhere
+type fakeSOCKS5Server struct {
+	username, password string // Password authentication is required if set
+	reply              byte   // The CONNECT reply code
+	silent             bool   // Never answers the greeting
+	requested          chan string
+}
+
+func (s *fakeSOCKS5Server) start(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.requested = make(chan string, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if s.serve(conn) {
+			io.Copy(conn, conn)
+		} else if s.silent {
+			io.Copy(io.Discard, conn) // Until the client gives up
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Returns true if the client is connected
+func (s *fakeSOCKS5Server) serve(conn net.Conn) bool {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil || s.silent {
+		return false
+	}
+
+	method := byte(socks5AuthNone)
+	if s.username != "" {
+		method = socks5NoAcceptable
+		if strings.Contains(string(methods), string([]byte{socks5AuthPassword})) {
+			method = socks5AuthPassword
+		}
+	}
+	conn.Write([]byte{socks5Version, method})
+	switch method {
+	case socks5NoAcceptable:
+		return false
+	case socks5AuthPassword:
+		username, password := s.readAuthentication(conn)
+		if username != s.username || password != s.password {
+			conn.Write([]byte{socks5PasswordAuthV1, 1})
+			return false
+		}
+		conn.Write([]byte{socks5PasswordAuthV1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != socks5CmdConnect {
+		return false
+	}
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return false
+	}
+	s.requested <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	conn.Write([]byte{socks5Version, s.reply, 0, socks5AddrIPv4, 127, 0, 0, 1, 0x1a, 0xe1})
+	return s.reply == 0
+}
+
+func (s *fakeSOCKS5Server) readAuthentication(conn net.Conn) (username, password string) {
+	readString := func() string {
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		value := make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+	version := make([]byte, 1)
+	io.ReadFull(conn, version)
+	username = readString()
+	password = readString()
+	return
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	tests := []struct {
+		name               string
+		server             fakeSOCKS5Server
+		username, password string
+		address            string
+		wantErr            string // Empty if the connection should succeed
+	}{
+		{"no authentication", fakeSOCKS5Server{}, "", "", "10.1.2.3:6881", ""},
+		{"no authentication with a host name", fakeSOCKS5Server{}, "user", "pass", "peer.example.com:51413", ""},
+		{"ipv6", fakeSOCKS5Server{}, "", "", "[2001:db8::1]:6881", ""},
+		{"password", fakeSOCKS5Server{username: "user", password: "pass"}, "user", "pass", "10.1.2.3:6881", ""},
+		{"wrong password", fakeSOCKS5Server{username: "user", password: "pass"}, "user", "wrong", "10.1.2.3:6881", "Authentication failed"},
+		{"missing password", fakeSOCKS5Server{username: "user", password: "pass"}, "", "", "10.1.2.3:6881", "No acceptable authentication methods"},
+		{"connection refused", fakeSOCKS5Server{reply: 0x05}, "", "", "10.1.2.3:6881", "connection refused"},
+		{"unknown error", fakeSOCKS5Server{reply: 0x42}, "", "", "10.1.2.3:6881", "Unknown SOCKS5 error 66"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := test.server
+			dialer := &SOCKS5Dialer{ProxyAddress: server.start(t), Username: test.username, Password: test.password}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialer.DialContext(ctx, "tcp", test.address)
+			if test.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("Expected an error with %q", test.wantErr)
+				}
+				if !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("Expected an error with %q, got %q", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			defer conn.Close()
+
+			if requested := <-server.requested; requested != test.address {
+				t.Errorf("Proxy was asked to connect to %s, expected %s", requested, test.address)
+			}
+			// The connection is usable after the negotiation, without any deadlines
+			message := []byte("hello through the proxy")
+			conn.Write(message)
+			echoed := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != string(message) {
+				t.Errorf("Expected %q to be echoed, got %q (%v)", message, echoed, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5DialerContext(t *testing.T) {
+	server := &fakeSOCKS5Server{silent: true}
+	dialer := &SOCKS5Dialer{ProxyAddress: server.start(t)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := dialer.DialContext(ctx, "tcp", "10.1.2.3:6881")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled dial, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Cancelling the dial took %s", elapsed)
+	}
+
+	// The errors of the forward dialer are wrapped as well
+	dialer = &SOCKS5Dialer{ProxyAddress: "127.0.0.1:6881", Forward: &closingDialer{}}
+	if _, err = dialer.DialContext(context.Background(), "tcp", "10.1.2.3:6881"); err == nil || !strings.Contains(err.Error(), "Could not connect to SOCKS5 proxy") {
+		t.Errorf("Expected a proxy connection error, got %v", err)
+	}
+}
@@ -4,10 +4,22 @@
 package peer
 
 import (
+	"bufio"
 	"bytes"
+	"io"
 	"net"
 )
 
+// A connection whose reads go through a buffered reader, so we can peek at the data
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func string2Bytes(s string) []byte {
 	return bytes.NewBufferString(s).Bytes()
 }
@@ -27,7 +39,8 @@ func bytesToUint32(buf []byte) uint32 {
 
 func netReadUint32(conn net.Conn) (n uint32, err error) {
 	var buf [4]byte
-	_, err = conn.Read(buf[0:])
+	// A single Read can return fewer bytes, e.g. from buffered or encrypted connections
+	_, err = io.ReadFull(conn, buf[0:])
 	if err != nil {
 		return
 	}
@@ -0,0 +1,58 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetReadUint32ShortReads(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Every Write on a pipe is received by a separate Read
+	go func() {
+		server.Write([]byte{0x01, 0x02})
+		server.Write([]byte{0x03})
+		server.Write([]byte{0x04})
+	}()
+
+	n, err := netReadUint32(client)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 0x01020304 {
+		t.Errorf("Expected %#x, got %#x", 0x01020304, n)
+	}
+}
+
+func TestPeerReaderKeepAlives(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	messages, errs := createPeerReader(client, done, &DefaultOptions)
+
+	go func() {
+		server.Write([]byte{0, 0, 0, 0})             // Keep-alive
+		server.Write([]byte{0, 0, 0, 2, 20, 0})      // Extension handshake
+		server.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0}) // Two more keep-alives
+		server.Write([]byte{0, 0, 0, 1, 1})          // Unchoke
+	}()
+
+	for i, want := range []string{"", "\x14\x00", "", "", "\x01"} {
+		select {
+		case msg := <-messages:
+			if string(msg) != want {
+				t.Fatalf("Expected message #%d to be %q, got %q", i, want, msg)
+			}
+		case err := <-errs:
+			t.Fatalf("Unexpected error for message #%d: %s", i, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message #%d was not received", i)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/na--/winston/torrent/peer"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	httpTimeout         = 30 * time.Second
+	maxHTTPResponseSize = 1024 * 1024
+)
+
+// HTTPClient is used for all requests to HTTP trackers
+var HTTPClient = &http.Client{Timeout: httpTimeout}
+
+// Builds the announce URL, keeping the query parameters the tracker URL may already have
+func announceURL(u *url.URL, req AnnounceRequest) string {
+	params := []string{
+		"info_hash=" + url.QueryEscape(req.InfoHash),
+		"peer_id=" + url.QueryEscape(req.PeerID),
+		"port=" + strconv.Itoa(int(req.Port)),
+		"uploaded=" + strconv.FormatInt(req.Uploaded, 10),
+		"downloaded=" + strconv.FormatInt(req.Downloaded, 10),
+		"left=" + strconv.FormatInt(req.Left, 10),
+		"compact=1", // BEP23
+	}
+	if req.Event != EventNone {
+		params = append(params, "event="+req.Event)
+	}
+	if req.NumWant > 0 {
+		params = append(params, "numwant="+strconv.Itoa(req.NumWant))
+	}
+
+	// The infohash and peer ID are raw bytes, so url.Values can't be used
+	// without breaking them for some trackers
+	result := *u
+	if result.RawQuery != "" {
+		result.RawQuery += "&"
+	}
+	result.RawQuery += strings.Join(params, "&")
+	return result.String()
+}
+
+func announceHTTP(ctx context.Context, u *url.URL, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", announceURL(u, req), nil)
+	if err != nil {
+		return
+	}
+
+	httpResp, err := HTTPClient.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Tracker responded with HTTP status %s", httpResp.Status)
+		return
+	}
+
+	return parseHTTPResponse(io.LimitReader(httpResp.Body, maxHTTPResponseSize))
+}
+
+func parseHTTPResponse(r io.Reader) (resp *AnnounceResponse, err error) {
+	data, err := bencode.Decode(r)
+	if err != nil {
+		err = fmt.Errorf("Could not decode tracker response: %s", err)
+		return
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("Tracker response is not a dictionary")
+		return
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		err = &FailureError{Reason: reason}
+		return
+	}
+	if warning, ok := dict["warning message"].(string); ok {
+		log.V(2).Infof("WINSTON: Tracker warning: %s\n", warning)
+	}
+
+	resp = &AnnounceResponse{}
+	if interval, ok := dict["interval"].(int64); ok {
+		resp.Interval = time.Duration(interval) * time.Second
+	}
+	if interval, ok := dict["min interval"].(int64); ok {
+		resp.MinInterval = time.Duration(interval) * time.Second
+	}
+	if complete, ok := dict["complete"].(int64); ok {
+		resp.Seeders = int(complete)
+	}
+	if incomplete, ok := dict["incomplete"].(int64); ok {
+		resp.Leechers = int(incomplete)
+	}
+
+	switch peers := dict["peers"].(type) {
+	case string: // BEP23 compact format
+		resp.Peers, err = peer.DecodeCompactPeers([]byte(peers), false)
+	case []interface{}: // The original format from BEP3, a list of dictionaries
+		resp.Peers, err = parseDictionaryPeers(peers)
+	case nil:
+	default:
+		err = fmt.Errorf("Invalid peers in tracker response")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// BEP7
+	if peers6, ok := dict["peers6"].(string); ok {
+		ipv6Peers, err := peer.DecodeCompactPeers([]byte(peers6), true)
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, ipv6Peers...)
+	}
+
+	return
+}
+
+func parseDictionaryPeers(list []interface{}) (peers []string, err error) {
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("Invalid peer in tracker response")
+			return
+		}
+		ip, ipOk := dict["ip"].(string)
+		port, portOk := dict["port"].(int64)
+		if !ipOk || !portOk || port <= 0 || port > 65535 {
+			err = fmt.Errorf("Invalid peer in tracker response")
+			return
+		}
+		peers = append(peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Raw bytes that have to be escaped in the query string
+const (
+	testInfoHash = "\x00\x01& =+%?#/\xff\xfe\x80abcdefg"
+	testPeerID   = "-md1234_\x00&=+ %\xffxyz12"
+)
+
+func TestHTTPAnnounce(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    string
+		status      int
+		want        *AnnounceResponse
+		wantErr     bool
+		wantFailure string
+	}{
+		{
+			name:     "compact peers",
+			response: "d8:completei5e10:incompletei7e8:intervali1800e12:min intervali60e5:peers12:\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50e",
+			want: &AnnounceResponse{
+				Interval:    30 * time.Minute,
+				MinInterval: time.Minute,
+				Peers:       []string{"10.0.0.1:6881", "192.168.1.2:80"},
+				Seeders:     5,
+				Leechers:    7,
+			},
+		},
+		{
+			name:     "dictionary peers",
+			response: "d8:intervali900e5:peersld2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip11:example.org4:porti80eeee",
+			want:     &AnnounceResponse{Interval: 15 * time.Minute, Peers: []string{"10.0.0.1:6881", "example.org:80"}},
+		},
+		{
+			name:     "peers6",
+			response: "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5e",
+			want:     &AnnounceResponse{Interval: 15 * time.Minute, Peers: []string{"10.0.0.1:6881", "[2001:db8::1]:51413"}},
+		},
+		{
+			name:     "no peers",
+			response: "d8:intervali900ee",
+			want:     &AnnounceResponse{Interval: 15 * time.Minute},
+		},
+		{name: "failure reason", response: "d14:failure reason17:torrent not founde", wantFailure: "torrent not found"},
+		{name: "truncated peers", response: "d5:peers5:\x0a\x00\x00\x01\x1ae", wantErr: true},
+		{name: "truncated peers6", response: "d6:peers66:\x0a\x00\x00\x01\x1a\xe1e", wantErr: true},
+		{name: "invalid dictionary peer", response: "d5:peersld2:ip8:10.0.0.14:porti70000eeee", wantErr: true},
+		{name: "not a dictionary", response: "li1ee", wantErr: true},
+		{name: "http error", status: http.StatusNotFound, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var query url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query()
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			req := AnnounceRequest{InfoHash: testInfoHash, PeerID: testPeerID, Port: 51413, Left: 1, Event: EventStarted, NumWant: 50}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := Announce(ctx, server.URL+"/announce?passkey=secret", req)
+
+			// The raw bytes arrive intact, along with the tracker's own parameters
+			wantQuery := url.Values{
+				"passkey": {"secret"}, "info_hash": {testInfoHash}, "peer_id": {testPeerID},
+				"port": {"51413"}, "uploaded": {"0"}, "downloaded": {"0"}, "left": {"1"},
+				"compact": {"1"}, "event": {"started"}, "numwant": {"50"},
+			}
+			if !reflect.DeepEqual(query, wantQuery) {
+				t.Errorf("Tracker received query %q, expected %q", query, wantQuery)
+			}
+
+			var failure *FailureError
+			switch {
+			case test.wantFailure != "":
+				if !errors.As(err, &failure) || failure.Reason != test.wantFailure {
+					t.Errorf("Expected failure %q, got %v", test.wantFailure, err)
+				}
+			case test.wantErr:
+				if err == nil {
+					t.Errorf("Expected an error, got %+v", resp)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error: %s", err)
+			case !reflect.DeepEqual(resp, test.want):
+				t.Errorf("Expected response %+v, got %+v", test.want, resp)
+			}
+		})
+	}
+}
+
+func TestAnnounceURL(t *testing.T) {
+	u, _ := url.Parse("http://tracker.example.org/announce")
+	got := announceURL(u, AnnounceRequest{InfoHash: "\x12\x34 &", PeerID: "id", Port: 6881})
+	want := "http://tracker.example.org/announce?info_hash=%124+%26&peer_id=id&port=6881&uploaded=0&downloaded=0&left=0&compact=1"
+	if got != want {
+		t.Errorf("Expected announce URL %s, got %s", want, got)
+	}
+}
+
+func TestAnnounceLoopStops(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantEvents []string
+	}{
+		{name: "announced", wantEvents: []string{"started", "stopped"}},
+		{name: "never announced", status: http.StatusInternalServerError, wantEvents: []string{"started"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queries := make(chan url.Values, 10)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queries <- r.URL.Query()
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Write([]byte("d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"))
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			peers := make(chan []string, 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				AnnounceLoop(ctx, server.URL+"/announce", AnnounceRequest{InfoHash: testInfoHash}, peers)
+			}()
+
+			var events []string
+			var peerIDs []string
+			receive := func() {
+				select {
+				case query := <-queries:
+					events = append(events, query.Get("event"))
+					peerIDs = append(peerIDs, query.Get("peer_id"))
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out while waiting for an announce, received %q", events)
+				}
+			}
+			receive()
+			if test.status == 0 {
+				if batch := <-peers; !reflect.DeepEqual(batch, []string{"10.0.0.1:6881"}) {
+					t.Errorf("Unexpected peers %q", batch)
+				}
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("AnnounceLoop did not return after it was cancelled")
+			}
+			for len(queries) > 0 {
+				receive()
+			}
+
+			if !reflect.DeepEqual(events, test.wantEvents) {
+				t.Errorf("Tracker received the events %q, expected %q", events, test.wantEvents)
+			}
+			for _, id := range peerIDs {
+				if len(id) != 20 || id != peerIDs[0] {
+					t.Errorf("Tracker received the peer IDs %q", peerIDs)
+					break
+				}
+			}
+		})
+	}
+}
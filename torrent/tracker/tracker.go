@@ -0,0 +1,172 @@
+// Package tracker implements clients for BitTorrent trackers, which are used
+// as an additional source of peers for torrents, besides the DHT
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/na--/winston/torrent/peer"
+)
+
+const (
+	defaultInterval = 30 * time.Minute // When the tracker doesn't specify one
+	minInterval     = 1 * time.Minute  // Don't let trackers make us spam them
+	minRetryDelay   = 30 * time.Second
+	maxRetryDelay   = 30 * time.Minute
+	stoppedTimeout  = 5 * time.Second // For the best-effort announce when we stop
+)
+
+// Announce events
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// AnnounceRequest contains the information we send to the tracker
+type AnnounceRequest struct {
+	InfoHash   string // The raw 20-byte infohash
+	PeerID     string // A random one is generated if it's empty
+	Port       uint16 // The port on which we accept incoming connections
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	NumWant    int // Number of peers we want, the tracker default if 0
+}
+
+// AnnounceResponse contains the information the tracker returned
+type AnnounceResponse struct {
+	Interval    time.Duration // How long to wait before the next announce
+	MinInterval time.Duration // Zero if the tracker didn't specify it
+	Peers       []string      // In the host:port format
+	Seeders     int
+	Leechers    int
+}
+
+// FailureError is returned when the tracker explicitly refused our request
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("Tracker returned failure: %s", e.Reason)
+}
+
+// Announce sends the request to the tracker and returns the peers it responded with.
+// The protocol is chosen by the scheme of the tracker URL.
+func Announce(ctx context.Context, trackerURL string, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		err = fmt.Errorf("Invalid tracker URL '%s': %s", trackerURL, err)
+		return
+	}
+
+	if req.PeerID == "" {
+		req.PeerID = peer.NewPeerID()
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, u, req)
+	case "udp":
+		return announceUDP(ctx, u, req)
+	default:
+		err = fmt.Errorf("Unsupported tracker protocol '%s'", u.Scheme)
+		return
+	}
+}
+
+// Scrape returns the tracker statistics for the torrents with the specified
+// raw infohashes. Only UDP trackers are supported for now.
+func Scrape(ctx context.Context, trackerURL string, infoHashes []string) (results []ScrapeResult, err error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		err = fmt.Errorf("Invalid tracker URL '%s': %s", trackerURL, err)
+		return
+	}
+
+	if u.Scheme != "udp" {
+		err = fmt.Errorf("Scraping is not supported for '%s' trackers", u.Scheme)
+		return
+	}
+	return scrapeUDP(ctx, u, infoHashes)
+}
+
+// AnnounceLoop periodically announces to the tracker and sends the received peers
+// to the channel until the context is cancelled. Failed announces are retried with
+// an exponential backoff. If the tracker knows about us when the context is
+// cancelled, it's told that we stopped, without waiting long for it.
+func AnnounceLoop(ctx context.Context, trackerURL string, req AnnounceRequest, peers chan<- []string) {
+	if req.PeerID == "" {
+		req.PeerID = peer.NewPeerID()
+	}
+	req.Event = EventStarted
+	retryDelay := minRetryDelay
+
+	defer func() {
+		if req.Event == EventStarted {
+			return // No announce was successful
+		}
+		stopCtx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+		defer cancel()
+		req.Event = EventStopped
+		if _, err := Announce(stopCtx, trackerURL, req); err != nil {
+			log.V(2).Infof("WINSTON: Stopped announce to %s for %x failed: %s\n", trackerURL, req.InfoHash, err)
+		}
+	}()
+
+	for {
+		var wait time.Duration
+		resp, err := Announce(ctx, trackerURL, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.V(2).Infof("WINSTON: Announce to %s for %x failed, retrying in %s: %s\n", trackerURL, req.InfoHash, retryDelay, err)
+			wait = retryDelay
+			retryDelay *= 2
+			if retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+		} else {
+			log.V(3).Infof("WINSTON: Tracker %s returned %d peers for %x (%d seeders, %d leechers)\n", trackerURL, len(resp.Peers), req.InfoHash, resp.Seeders, resp.Leechers)
+			req.Event = EventNone
+			retryDelay = minRetryDelay
+			wait = nextAnnounceDelay(resp)
+
+			if len(resp.Peers) > 0 {
+				select {
+				case peers <- resp.Peers:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func nextAnnounceDelay(resp *AnnounceResponse) time.Duration {
+	wait := resp.Interval
+	if wait <= 0 {
+		wait = defaultInterval
+	}
+	if wait < resp.MinInterval {
+		wait = resp.MinInterval
+	}
+	if wait < minInterval {
+		wait = minInterval
+	}
+	return wait
+}
@@ -0,0 +1,265 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/na--/winston/torrent/peer"
+)
+
+// UDP tracker protocol (BEP15) constants
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	maxUDPRetries       = 8
+	udpConnectionIDLife = 1 * time.Minute
+	maxUDPPacketSize    = 64 * 1024 // Announce responses with many peers can be large
+	maxScrapeInfoHashes = 74        // So the response fits in a single packet
+)
+
+// How long to wait for the first response, doubled after every failed attempt
+var udpBaseTimeout = 15 * time.Second
+
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// ScrapeResult contains the statistics that a tracker has for a single torrent
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type udpConnectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// Connection IDs can be reused for a minute, so they are cached for every tracker address
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: make(map[string]udpConnectionID)}
+
+// Identifies us to the trackers, even if our IP address changes
+var udpKey = randomUint32()
+
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Opens a "connection" to the UDP tracker, which is closed when ctx is cancelled
+func dialUDP(ctx context.Context, u *url.URL) (conn net.Conn, err error) {
+	if u.Port() == "" {
+		err = fmt.Errorf("UDP tracker URL '%s' has no port", u)
+		return
+	}
+	conn, err = (&net.Dialer{}).DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return
+}
+
+// Sends a single request and waits for the response with the same transaction ID.
+// The returned data is the response without its action and transaction ID.
+func udpExchange(conn net.Conn, timeout time.Duration, connectionID uint64, action uint32, payload []byte) (response []byte, err error) {
+	transactionID := randomUint32()
+
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, connectionID)
+	binary.Write(&request, binary.BigEndian, action)
+	binary.Write(&request, binary.BigEndian, transactionID)
+	request.Write(payload)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write(request.Bytes()); err != nil {
+		return
+	}
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			return
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue // Probably a late response to one of our previous requests
+		}
+
+		switch binary.BigEndian.Uint32(buf[0:4]) {
+		case action:
+			return buf[8:n], nil
+		case udpActionError:
+			return nil, &FailureError{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("Tracker responded with unexpected action %d", binary.BigEndian.Uint32(buf[0:4]))
+		}
+	}
+}
+
+// Returns a cached connection ID for the tracker or gets a new one
+func getUDPConnectionID(conn net.Conn, address string, timeout time.Duration) (id uint64, err error) {
+	udpConnectionIDs.Lock()
+	cached, ok := udpConnectionIDs.ids[address]
+	udpConnectionIDs.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	response, err := udpExchange(conn, timeout, udpProtocolID, udpActionConnect, nil)
+	if err != nil {
+		return
+	}
+	if len(response) < 8 {
+		err = fmt.Errorf("Connect response is too short (%d bytes)", len(response))
+		return
+	}
+	id = binary.BigEndian.Uint64(response[0:8])
+
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.ids[address] = udpConnectionID{id, time.Now().Add(udpConnectionIDLife)}
+	udpConnectionIDs.Unlock()
+	return
+}
+
+func forgetUDPConnectionID(address string) {
+	udpConnectionIDs.Lock()
+	delete(udpConnectionIDs.ids, address)
+	udpConnectionIDs.Unlock()
+}
+
+// Sends the request to the tracker, connecting first if needed. Requests that time
+// out are retransmitted after 15 * 2 ^ n seconds, as described in BEP15. The
+// tracker address is returned as well, since it determines the peer format.
+func udpRequest(ctx context.Context, u *url.URL, action uint32, payload []byte) (response []byte, remote *net.UDPAddr, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := dialUDP(ctx, u)
+	if err != nil {
+		return
+	}
+	remote, _ = conn.RemoteAddr().(*net.UDPAddr)
+
+	for attempt := 0; attempt <= maxUDPRetries; attempt++ {
+		timeout := udpBaseTimeout << uint(attempt)
+
+		var connectionID uint64
+		connectionID, err = getUDPConnectionID(conn, u.Host, timeout)
+		if err == nil {
+			response, err = udpExchange(conn, timeout, connectionID, action, payload)
+			if _, failed := err.(*FailureError); failed {
+				// The connection ID may have been rejected, get a new one next time
+				forgetUDPConnectionID(u.Host)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil, remote, ctx.Err()
+		}
+		if !isTimeout(err) {
+			return
+		}
+	}
+	return
+}
+
+func announceUDP(ctx context.Context, u *url.URL, req AnnounceRequest) (resp *AnnounceResponse, err error) {
+	var payload bytes.Buffer
+	payload.WriteString(req.InfoHash)
+	payload.WriteString(req.PeerID)
+	binary.Write(&payload, binary.BigEndian, req.Downloaded)
+	binary.Write(&payload, binary.BigEndian, req.Left)
+	binary.Write(&payload, binary.BigEndian, req.Uploaded)
+	binary.Write(&payload, binary.BigEndian, udpEvents[req.Event])
+	binary.Write(&payload, binary.BigEndian, uint32(0)) // Our IP address, the tracker should use the sender's
+	binary.Write(&payload, binary.BigEndian, udpKey)
+	numWant := int32(-1) // The tracker default
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	binary.Write(&payload, binary.BigEndian, numWant)
+	binary.Write(&payload, binary.BigEndian, req.Port)
+
+	response, remote, err := udpRequest(ctx, u, udpActionAnnounce, payload.Bytes())
+	if err != nil {
+		return
+	}
+	if len(response) < 12 {
+		err = fmt.Errorf("Announce response is too short (%d bytes)", len(response))
+		return
+	}
+
+	resp = &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(response[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(response[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(response[8:12])),
+	}
+	// Peers are in the IPv6 format only if we contacted the tracker over IPv6
+	ipv6 := remote != nil && remote.IP.To4() == nil
+	resp.Peers, err = peer.DecodeCompactPeers(response[12:], ipv6)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func scrapeUDP(ctx context.Context, u *url.URL, infoHashes []string) (results []ScrapeResult, err error) {
+	if len(infoHashes) > maxScrapeInfoHashes {
+		err = fmt.Errorf("Can't scrape more than %d torrents at once", maxScrapeInfoHashes)
+		return
+	}
+
+	var payload bytes.Buffer
+	for _, infoHash := range infoHashes {
+		payload.WriteString(infoHash)
+	}
+
+	response, _, err := udpRequest(ctx, u, udpActionScrape, payload.Bytes())
+	if err != nil {
+		return
+	}
+	if len(response) < 12*len(infoHashes) {
+		err = fmt.Errorf("Scrape response is too short (%d bytes)", len(response))
+		return
+	}
+
+	for i := range infoHashes {
+		data := response[i*12 : (i+1)*12]
+		results = append(results, ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(data[0:4])),
+			Completed: int(binary.BigEndian.Uint32(data[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(data[8:12])),
+		})
+	}
+	return
+}
@@ -0,0 +1,253 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A UDP tracker that returns the same peers for every torrent
+type fakeUDPTracker struct {
+	conn         net.PacketConn
+	connectionID uint64
+	peers        int // How many peers are returned
+
+	mu       sync.Mutex
+	drop     int    // How many of the next requests are ignored
+	mismatch bool   // Reply with a wrong transaction ID before every answer
+	failure  string // Reply to the next announce or scrape with this error
+	connects int
+	announce []byte // The last announce request
+}
+
+func startFakeUDPTracker(t *testing.T, peers int) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	tracker := &fakeUDPTracker{conn: conn, connectionID: 0x1122334455667788, peers: peers}
+	go tracker.serve()
+	return tracker
+}
+
+func (tr *fakeUDPTracker) url() string {
+	return "udp://" + tr.conn.LocalAddr().String() + "/announce"
+}
+
+func (tr *fakeUDPTracker) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := tr.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := tr.handle(buf[:n]); reply != nil {
+			tr.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (tr *fakeUDPTracker) handle(request []byte) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.drop > 0 {
+		tr.drop--
+		return nil
+	}
+	if len(request) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(request[0:8])
+	action := binary.BigEndian.Uint32(request[8:12])
+	transactionID := binary.BigEndian.Uint32(request[12:16])
+	payload := request[16:]
+
+	var reply bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&reply, binary.BigEndian, value)
+		}
+	}
+	if tr.mismatch {
+		write(action, transactionID+1)
+		tr.conn.WriteTo(reply.Bytes(), nil)
+		reply.Reset()
+	}
+
+	switch {
+	case action == udpActionConnect && connectionID == udpProtocolID:
+		tr.connects++
+		write(uint32(udpActionConnect), transactionID, tr.connectionID)
+	case connectionID != tr.connectionID || tr.failure != "":
+		reason := tr.failure
+		if reason == "" {
+			reason = "invalid connection id"
+		}
+		tr.failure = ""
+		write(uint32(udpActionError), transactionID)
+		reply.WriteString(reason)
+	case action == udpActionAnnounce:
+		tr.announce = append([]byte(nil), payload...)
+		write(action, transactionID, uint32(1800), uint32(2), uint32(3))
+		for i := 0; i < tr.peers; i++ {
+			write([4]byte{10, 0, byte(i >> 8), byte(i)}, uint16(6881))
+		}
+	case action == udpActionScrape:
+		write(action, transactionID)
+		for i := 0; i < len(payload)/20; i++ {
+			write(uint32(i+1), uint32(10), uint32(i+2))
+		}
+	}
+	return reply.Bytes()
+}
+
+func (tr *fakeUDPTracker) set(f func()) {
+	tr.mu.Lock()
+	f()
+	tr.mu.Unlock()
+}
+
+func (tr *fakeUDPTracker) connectCount() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.connects
+}
+
+func expectedPeers(count int) (peers []string) {
+	for i := 0; i < count; i++ {
+		peers = append(peers, fmt.Sprintf("10.0.%d.%d:6881", i>>8, i&0xff))
+	}
+	return
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	udpBaseTimeout = 100 * time.Millisecond
+	defer func() { udpBaseTimeout = 15 * time.Second }()
+
+	tests := []struct {
+		name         string
+		peers        int
+		setup        func(tr *fakeUDPTracker)
+		wantFailure  string
+		wantConnects int
+	}{
+		{name: "announce", peers: 2, wantConnects: 1},
+		{name: "no peers", peers: 0, wantConnects: 1},
+		// More than fits in the usual MTU
+		{name: "large response", peers: 2000, wantConnects: 1},
+		{name: "wrong transaction id", peers: 2, setup: func(tr *fakeUDPTracker) { tr.mismatch = true }, wantConnects: 1},
+		{name: "dropped connect", peers: 2, setup: func(tr *fakeUDPTracker) { tr.drop = 1 }, wantConnects: 1},
+		{name: "dropped connect and announce", peers: 2, setup: func(tr *fakeUDPTracker) { tr.drop = 2 }, wantConnects: 1},
+		{name: "error", peers: 2, setup: func(tr *fakeUDPTracker) { tr.failure = "torrent not registered" }, wantFailure: "torrent not registered", wantConnects: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := startFakeUDPTracker(t, test.peers)
+			if test.setup != nil {
+				tracker.set(func() { test.setup(tracker) })
+			}
+
+			req := AnnounceRequest{InfoHash: testInfoHash, PeerID: "-md1234_567890123456", Port: 51413, Left: 1, Event: EventStarted, NumWant: 50}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := Announce(ctx, tracker.url(), req)
+
+			if connects := tracker.connectCount(); connects != test.wantConnects {
+				t.Errorf("Expected %d connect requests, got %d", test.wantConnects, connects)
+			}
+			if test.wantFailure != "" {
+				var failure *FailureError
+				if !errors.As(err, &failure) || failure.Reason != test.wantFailure {
+					t.Errorf("Expected failure %q, got %v", test.wantFailure, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			want := &AnnounceResponse{Interval: 30 * time.Minute, Leechers: 2, Seeders: 3, Peers: expectedPeers(test.peers)}
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("Expected response %+v, got %+v", want, resp)
+			}
+			tracker.set(func() {
+				if len(tracker.announce) != 82 || string(tracker.announce[:20]) != req.InfoHash || string(tracker.announce[20:40]) != req.PeerID {
+					t.Errorf("Tracker received an invalid announce %x", tracker.announce)
+				} else if event, port := binary.BigEndian.Uint32(tracker.announce[64:68]), binary.BigEndian.Uint16(tracker.announce[80:82]); event != 2 || port != req.Port {
+					t.Errorf("Tracker received event %d and port %d", event, port)
+				}
+			})
+		})
+	}
+}
+
+func TestUDPConnectionIDs(t *testing.T) {
+	tracker := startFakeUDPTracker(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	announce := func() error {
+		_, err := Announce(ctx, tracker.url(), AnnounceRequest{InfoHash: testInfoHash})
+		return err
+	}
+
+	// The connection ID is reused for the following requests
+	for i := 0; i < 3; i++ {
+		if err := announce(); err != nil {
+			t.Fatalf("Announce #%d failed: %s", i, err)
+		}
+	}
+	if _, err := Scrape(ctx, tracker.url(), []string{testInfoHash}); err != nil {
+		t.Fatalf("Scrape failed: %s", err)
+	}
+	if connects := tracker.connectCount(); connects != 1 {
+		t.Errorf("Expected a single connect request, got %d", connects)
+	}
+
+	// A new one is requested after the tracker rejects the old one
+	tracker.set(func() { tracker.connectionID++ })
+	var failure *FailureError
+	if err := announce(); !errors.As(err, &failure) {
+		t.Errorf("Expected the old connection ID to be rejected, got %v", err)
+	}
+	if err := announce(); err != nil {
+		t.Errorf("Announce with a new connection ID failed: %s", err)
+	}
+	if connects := tracker.connectCount(); connects != 2 {
+		t.Errorf("Expected two connect requests, got %d", connects)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	tracker := startFakeUDPTracker(t, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results, err := Scrape(ctx, tracker.url(), []string{testInfoHash, "01234567890123456789", "abcdefghijabcdefghij"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := []ScrapeResult{{1, 10, 2}, {2, 10, 3}, {3, 10, 4}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected results %v, got %v", want, results)
+	}
+
+	tracker.set(func() { tracker.failure = "scrape not allowed" })
+	var failure *FailureError
+	if _, err = Scrape(ctx, tracker.url(), []string{testInfoHash}); !errors.As(err, &failure) || failure.Reason != "scrape not allowed" {
+		t.Errorf("Expected a scrape failure, got %v", err)
+	}
+
+	if _, err = Scrape(ctx, "http://tracker.example.org/announce", []string{testInfoHash}); err == nil {
+		t.Errorf("Expected an error for scraping an HTTP tracker")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/na--/winston/torrent/metadata"
+)
+
+var verifyRemoveInvalid *bool
+
+var verifyCommand = &command{
+	name:        "verify",
+	args:        "[infohash1|magnet1 infohash2|magnet2 ...]",
+	description: "Check that the saved torrent files match their infohashes, all files in the output folder if none are specified.",
+	setFlags: func(fs *flag.FlagSet) {
+		verifyRemoveInvalid = fs.Bool("remove_invalid", false, "Delete the torrent files that don't match their infohashes, so they can be downloaded again.")
+	},
+	run: verify,
+}
+
+func verify(args []string) error {
+	options, err := metadata.OptionsFromFlags()
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+	saved := metadata.SavedMetadata{Folder: options.OutputFolder}
+
+	// The raw infohashes of the files that should be checked
+	var infoHashes []string
+	if len(args) > 0 {
+		for _, input := range args {
+			magnet, err := metadata.ParseMagnet(input)
+			if err != nil {
+				return fmt.Errorf("Invalid infohash or magnet link '%s': %s", input, err)
+			}
+			infoHashes = append(infoHashes, magnet.InfoHash)
+		}
+	} else {
+		// The files whose names don't end with an infohash are skipped
+		infoHashes = saved.InfoHashes()
+	}
+
+	invalid := 0
+	for _, infoHash := range infoHashes {
+		if _, err := saved.Load(infoHash); err != nil {
+			fmt.Printf("INVALID %x: %s\n", infoHash, err)
+			invalid++
+			if *verifyRemoveInvalid && !os.IsNotExist(err) {
+				if err := os.Remove(saved.Path(infoHash)); err != nil {
+					fmt.Printf("Could not remove %s: %s\n", saved.Path(infoHash), err)
+				}
+			}
+			continue
+		}
+		fmt.Printf("OK      %x\n", infoHash)
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d out of %d torrent files are invalid", invalid, len(infoHashes))
+	}
+	return nil
+}